@@ -0,0 +1,265 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	ginResource "github.com/otamoe/gin-server/resource"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// Token.ValidateScope 的 每个 决定
+	AuditEvent struct {
+		Time          time.Time     `json:"time" bson:"time"`
+		TokenID       bson.ObjectId `json:"token_id,omitempty" bson:"token,omitempty"`
+		UserID        bson.ObjectId `json:"user_id,omitempty" bson:"user,omitempty"`
+		ClientID      bson.ObjectId `json:"client_id,omitempty" bson:"client,omitempty"`
+		ApplicationID bson.ObjectId `json:"application_id,omitempty" bson:"application,omitempty"`
+		Action        string        `json:"action" bson:"action"`
+		Type          string        `json:"type" bson:"type"`
+		OwnerID       bson.ObjectId `json:"owner_id,omitempty" bson:"owner,omitempty"`
+
+		// 匹配到的 scope level 和 roles 下标,  没有 匹配 是 nil
+		ScopeLevel *int `json:"scope_level,omitempty" bson:"scope_level,omitempty"`
+		RoleIndex  *int `json:"role_index,omitempty" bson:"role_index,omitempty"`
+
+		// allow 或 deny
+		Outcome string `json:"outcome" bson:"outcome"`
+		// approved, banned, no_scope, no_role
+		Reason string `json:"reason" bson:"reason"`
+	}
+
+	AuditSink interface {
+		Audit(ctx context.Context, event *AuditEvent) error
+	}
+
+	// Handle.Stop 时 调用,  写完 队列
+	auditStopper interface {
+		Stop()
+	}
+
+	// Collector 的 auth_audit_dropped_total
+	auditDropper interface {
+		Dropped() uint64
+	}
+
+	// 写入 一个 集合,  文档格式 和 AuditEvent 的 bson 一样.  默认 异步 写入,  Stop 写完 队列
+	MongoAuditSink struct {
+		Collection *mongo.Collection
+		// 每次 写入 的 超时,  0 是 5 秒
+		Timeout time.Duration
+		// 队列 大小,  0 是 10000,  满了 丢弃 并 计数
+		QueueSize int
+		// 同步 写入,  ValidateScope 等待 写完,  最多 Timeout
+		Sync bool
+
+		queue auditQueue
+	}
+
+	// 和 MongoAuditSink 一样,  使用 mgo.  每次 写入 复制 Session
+	MgoAuditSink struct {
+		Session *mgo.Session
+		// Session 默认 数据库 的 集合
+		Collection string
+		QueueSize  int
+		Sync       bool
+
+		queue auditQueue
+	}
+
+	// 每个 事件 一行 JSON,  使用 NewWriterAuditSink 创建
+	WriterAuditSink struct {
+		mutex   sync.Mutex
+		encoder *json.Encoder
+	}
+
+	// 异步 写入 的 队列,  第一次 push 时 启动
+	auditQueue struct {
+		mutex   sync.Mutex
+		events  chan *AuditEvent
+		done    chan struct{}
+		dropped uint64
+	}
+
+	scopeMatch struct {
+		level  *int
+		role   *int
+		reason string
+	}
+)
+
+var ErrAuditWriterMissing = errors.New("audit writer missing, use NewWriterAuditSink")
+
+const (
+	AuditReasonApproved = "approved"
+	AuditReasonBanned   = "banned"
+	AuditReasonNoScope  = "no_scope"
+	AuditReasonNoRole   = "no_role"
+)
+
+// name 为空 使用 "audits"
+func NewMongoAuditSink(database *mongo.Database, name string) *MongoAuditSink {
+	if name == "" {
+		name = "audits"
+	}
+	return &MongoAuditSink{
+		Collection: database.Collection(name, options.Collection().SetRegistry(mongoRegistry)),
+	}
+}
+
+// 请求 取消 也 写入,  最多 等待 Timeout
+func (sink *MongoAuditSink) Audit(ctx context.Context, event *AuditEvent) (err error) {
+	if !sink.Sync {
+		sink.queue.push(event, sink.QueueSize, func(event *AuditEvent) error {
+			return sink.insert(context.Background(), event)
+		})
+		return
+	}
+	return sink.insert(ctx, event)
+}
+
+func (sink *MongoAuditSink) insert(ctx context.Context, event *AuditEvent) (err error) {
+	timeout := sink.Timeout
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(upstreamContext(ctx)), timeout)
+	defer cancel()
+	_, err = sink.Collection.InsertOne(ctx, event)
+	return
+}
+
+// 队列 满了 丢弃的 事件 数量
+func (sink *MongoAuditSink) Dropped() uint64 {
+	return sink.queue.getDropped()
+}
+
+// 等待 队列 写完,  之后 Audit 会 重新 启动
+func (sink *MongoAuditSink) Stop() {
+	sink.queue.stop()
+}
+
+// name 为空 使用 "audits"
+func NewMgoAuditSink(session *mgo.Session, name string) *MgoAuditSink {
+	if name == "" {
+		name = "audits"
+	}
+	return &MgoAuditSink{
+		Session:    session,
+		Collection: name,
+	}
+}
+
+func (sink *MgoAuditSink) Audit(ctx context.Context, event *AuditEvent) (err error) {
+	if !sink.Sync {
+		sink.queue.push(event, sink.QueueSize, sink.insert)
+		return
+	}
+	return sink.insert(event)
+}
+
+func (sink *MgoAuditSink) insert(event *AuditEvent) (err error) {
+	session := sink.Session.Copy()
+	defer session.Close()
+	return session.DB("").C(sink.Collection).Insert(event)
+}
+
+func (sink *MgoAuditSink) Dropped() uint64 {
+	return sink.queue.getDropped()
+}
+
+func (sink *MgoAuditSink) Stop() {
+	sink.queue.stop()
+}
+
+// 不 阻塞,  满了 返回 false
+func (queue *auditQueue) push(event *AuditEvent, size int, write func(event *AuditEvent) error) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if queue.events == nil {
+		if size <= 0 {
+			size = 10000
+		}
+		queue.events = make(chan *AuditEvent, size)
+		queue.done = make(chan struct{})
+		go queue.run(queue.events, queue.done, write)
+	}
+	select {
+	case queue.events <- event:
+		return true
+	default:
+		atomic.AddUint64(&queue.dropped, 1)
+		return false
+	}
+}
+
+func (queue *auditQueue) run(events chan *AuditEvent, done chan struct{}, write func(event *AuditEvent) error) {
+	defer close(done)
+	for event := range events {
+		if err := write(event); err != nil {
+			logrus.Error("[AUDIT]", err)
+		}
+	}
+}
+
+func (queue *auditQueue) stop() {
+	queue.mutex.Lock()
+	events, done := queue.events, queue.done
+	queue.events, queue.done = nil, nil
+	queue.mutex.Unlock()
+	if events != nil {
+		close(events)
+		<-done
+	}
+}
+
+func (queue *auditQueue) getDropped() uint64 {
+	return atomic.LoadUint64(&queue.dropped)
+}
+
+func NewWriterAuditSink(w io.Writer) *WriterAuditSink {
+	return &WriterAuditSink{encoder: json.NewEncoder(w)}
+}
+
+func (sink *WriterAuditSink) Audit(ctx context.Context, event *AuditEvent) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.encoder == nil {
+		return ErrAuditWriterMissing
+	}
+	return sink.encoder.Encode(event)
+}
+
+func (auth *Auth) audit(ctx context.Context, token *Token, resource *ginResource.Resource, match scopeMatch, err error) {
+	sink := auth.Options().AuditLog
+	if sink == nil {
+		return
+	}
+	event := &AuditEvent{
+		Time:          time.Now(),
+		TokenID:       token.ID,
+		UserID:        token.UserID,
+		ClientID:      token.ClientID,
+		ApplicationID: resource.Application,
+		Action:        resource.Action,
+		Type:          resource.Type,
+		OwnerID:       resource.Owner,
+		ScopeLevel:    match.level,
+		RoleIndex:     match.role,
+		Outcome:       scopeDecision(err),
+		Reason:        match.reason,
+	}
+	if e := sink.Audit(ctx, event); e != nil {
+		logrus.Error("[AUDIT]", e)
+	}
+}
@@ -0,0 +1,175 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	ginResource "github.com/otamoe/gin-server/resource"
+	"github.com/prometheus/client_golang/prometheus"
+	mongoBson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestAudit(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	auth := NewAuth(Options{AuditLog: NewWriterAuditSink(buffer)})
+	application := bson.NewObjectId()
+	token := &Token{
+		ID:     bson.NewObjectId(),
+		UserID: bson.NewObjectId(),
+		UserScopes: []*UserScope{
+			{
+				Scope: &Scope{
+					ApplicationID: application,
+					Level:         2,
+					Roles: []ScopeRole{
+						{Status: "approved", User: "*", Type: "*", Action: "delete"},
+						{Status: "approved", User: "*", Type: "*", Action: "get"},
+					},
+				},
+			},
+		},
+		auth: auth,
+	}
+	if _, err := token.ValidateScope(&ginResource.Resource{Application: application, Type: "users", Action: "get"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := token.ValidateScope(&ginResource.Resource{Application: bson.NewObjectId(), Type: "users", Action: "get"}); err == nil {
+		t.Fatal("other application")
+	}
+
+	decoder := json.NewDecoder(buffer)
+	allow, deny := &AuditEvent{}, &AuditEvent{}
+	if err := decoder.Decode(allow); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoder.Decode(deny); err != nil {
+		t.Fatal(err)
+	}
+	if allow.Outcome != "allow" || allow.Reason != AuditReasonApproved || allow.TokenID != token.ID || allow.ScopeLevel == nil || *allow.ScopeLevel != 2 || allow.RoleIndex == nil || *allow.RoleIndex != 1 {
+		t.Fatal("allow", allow)
+	}
+	if deny.Outcome != "deny" || deny.Reason != AuditReasonNoScope || deny.ScopeLevel != nil {
+		t.Fatal("deny", deny)
+	}
+
+	// MongoAuditSink 的 文档
+	data, err := mongoBson.MarshalWithRegistry(mongoRegistry, allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := mongoBson.Raw(data)
+	if raw.Lookup("token").Type != mongoBson.TypeObjectID || raw.Lookup("scope_level").AsInt64() != 2 {
+		t.Fatal("bson", raw)
+	}
+	if _, err = raw.LookupErr("owner"); err == nil {
+		t.Fatal("bson owner", raw)
+	}
+}
+
+func TestAuditSink(t *testing.T) {
+	// 零值 不 panic
+	if err := (&WriterAuditSink{}).Audit(context.Background(), &AuditEvent{}); err != ErrAuditWriterMissing {
+		t.Fatal("writer", err)
+	}
+
+	// 连接 不上 时 最多 等待 Timeout,  请求 已经 取消 也 一样
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	sink := NewMongoAuditSink(client.Database("test"), "")
+	sink.Timeout = time.Millisecond * 100
+	sink.Sync = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err = sink.Audit(ctx, &AuditEvent{}); err == nil {
+		t.Fatal("mongo")
+	}
+	if elapsed := time.Since(start); elapsed < sink.Timeout || elapsed > time.Second*2 {
+		t.Fatal("timeout", elapsed)
+	}
+}
+
+func TestAuditSinkAsync(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	sink := NewMongoAuditSink(client.Database("test"), "")
+	sink.Timeout = time.Millisecond * 100
+	sink.QueueSize = 1
+	auth := NewAuth(Options{Name: "a", AuditLog: sink})
+
+	// 不 等待 写入,  队列 满了 丢弃
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err = sink.Audit(context.Background(), &AuditEvent{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > sink.Timeout {
+		t.Fatal("async", elapsed)
+	}
+	if sink.Dropped() == 0 {
+		t.Fatal("dropped")
+	}
+	registry := prometheus.NewRegistry()
+	if err = registry.Register(auth.Collector()); err != nil {
+		t.Fatal(err)
+	}
+	if values := gatherCounters(t, registry); values["auth_audit_dropped_total  a"] == 0 {
+		t.Fatal("auth_audit_dropped_total", values)
+	}
+
+	// Handle.Stop 写完 队列
+	auth.Start().Stop()
+	if sink.queue.events != nil {
+		t.Fatal("stop")
+	}
+	// 之后 可以 继续 使用
+	if err = sink.Audit(context.Background(), &AuditEvent{}); err != nil || sink.queue.events == nil {
+		t.Fatal("restart", err)
+	}
+	sink.Stop()
+}
+
+// 需要 MONGODB_URI,  写入 默认 数据库
+func TestMgoAuditSink(t *testing.T) {
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		t.Skip("MONGODB_URI not set")
+	}
+	session, err := mgo.Dial(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	sink := NewMgoAuditSink(session, "audits_test_"+bson.NewObjectId().Hex())
+	collection := session.DB("").C(sink.Collection)
+	defer collection.DropCollection()
+
+	event := &AuditEvent{Time: time.Now(), TokenID: bson.NewObjectId(), Action: "get", Outcome: "allow"}
+	if err = sink.Audit(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	// Stop 之后 已经 写入
+	sink.Stop()
+	result := &AuditEvent{}
+	if err = collection.Find(bson.M{"token": event.TokenID}).One(result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Action != "get" || result.Outcome != "allow" {
+		t.Fatal("event", result)
+	}
+}
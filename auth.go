@@ -0,0 +1,199 @@
+package model
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	Options struct {
+		AuthOrigin   string
+		UserOrigin   string
+		ClientID     string
+		ClientSecret string
+
+		// 默认 AuthOrigin + "/keys"
+		KeysURL string
+		Keys    KeysConfig
+		// 默认 AuthOrigin + "/introspect"
+		IntrospectionURL string
+		// 设置后 Start 会定时同步
+		RevocationURL string
+		// 同步 撤销列表 的 间隔,  0 是 1 分钟
+		RevocationRefreshPeriod time.Duration
+
+		// 允许的 签名算法,  nil 是 ES256 ES384 ES512 RS256 PS256 EdDSA
+		Algorithms []string
+		DPoP       DPoPConfig
+
+		// token 过期 多久之后 PurgeExpiredTokens 删除,  0 是 1 小时,  小于 0 过期 立即 删除
+		TokenExpireGrace time.Duration
+
+		// 第一次 使用 缓存 时 读取
+		Caches CacheConfig
+
+		// 默认 http.DefaultClient
+		HTTPClient *http.Client
+		Timeouts   Timeouts
+		Retry      RetryConfig
+		Breaker    BreakerConfig
+
+		// 默认 otel 全局 TracerProvider 和 W3C traceparent
+		TracerProvider trace.TracerProvider
+		Propagator     propagation.TextMapPropagator
+
+		// 每个 ValidateScope 决定 写入,  nil 不记录.  Handle.Stop 时 调用 sink 的 Stop 写完 异步 队列
+		AuditLog AuditSink
+
+		// 默认 MgoStore
+		TokenStore TokenStore
+		UserStore  UserStore
+
+		// metrics 的 name label,  同一个 registry 注册 多个 实例 时 必须 不同.  默认实例 是 "default"
+		Name string
+
+		// token 的 iss,  RegisterIssuer 使用
+		Issuer string
+		// 解析 JWT 前 修改 claims,  issuer 的 claim 和 TokenClaims 不一样 时 使用,  见 RenameClaims
+		MapClaims func(claims map[string]interface{}) error
+	}
+
+	// 一个 auth 部署,  有自己的 配置 公钥 缓存 和 撤销列表
+	Auth struct {
+		options Options
+		// 默认实例 使用 包变量 AuthOrigin UserOrigin ...
+		global bool
+
+		keys        tokenKeySet
+		caches      authCaches
+		revocations *revocationList
+		issuers     issuerSet
+		metrics     *authMetrics
+
+		tokenFlight    flightGroup
+		userFlight     flightGroup
+		userRefreshing sync.Map
+		breakers       sync.Map
+		dpopReplay     dpopReplay
+
+		// Start 返回的 handle,  Stop 之后 是 nil
+		running struct {
+			sync.Mutex
+			handle *Handle
+		}
+	}
+)
+
+var defaultAuth = newAuth(Options{}, true)
+
+func NewAuth(options Options) *Auth {
+	return newAuth(options, false)
+}
+
+func newAuth(options Options, global bool) *Auth {
+	if options.TokenStore == nil {
+		options.TokenStore = MgoStore{}
+	}
+	if options.UserStore == nil {
+		options.UserStore = MgoStore{}
+	}
+	auth := &Auth{
+		options:     options,
+		global:      global,
+		revocations: newRevocationList(),
+	}
+	auth.metrics = newAuthMetrics(auth.Options().Name)
+	return auth
+}
+
+// 包函数 使用的 实例,  配置 是 包变量
+func Default() *Auth {
+	return defaultAuth
+}
+
+func (auth *Auth) Options() Options {
+	if !auth.global {
+		return auth.options
+	}
+	return Options{
+		AuthOrigin:   AuthOrigin,
+		UserOrigin:   UserOrigin,
+		ClientID:     ClientID,
+		ClientSecret: ClientSecret,
+		KeysURL:      KeysURL,
+		Keys: KeysConfig{
+			RefreshInterval: KeysRefreshInterval,
+			RefreshPeriod:   KeysRefreshPeriod,
+			RetryMin:        KeysRetryMin,
+			RetryMax:        KeysRetryMax,
+		},
+		IntrospectionURL:        IntrospectionURL,
+		RevocationURL:           RevocationURL,
+		RevocationRefreshPeriod: RevocationRefreshPeriod,
+		Algorithms:              Algorithms,
+		DPoP: DPoPConfig{
+			Algorithms:      DPoPAlgorithms,
+			ProofTTL:        DPoPProofTTL,
+			NonceTTL:        DPoPNonceTTL,
+			ReplayCacheSize: DPoPReplayCacheSize,
+		},
+		TokenExpireGrace: TokenExpireGrace,
+		HTTPClient:       HTTPClient,
+		Timeouts:         UpstreamTimeouts,
+		Retry:            UpstreamRetry,
+		Breaker:          UpstreamBreaker,
+		TracerProvider:   TracerProvider,
+		Propagator:       Propagator,
+		AuditLog:         AuditLog,
+		TokenStore:       TokenStorage,
+		UserStore:        UserStorage,
+		Name:             "default",
+		Caches: CacheConfig{
+			TokenSize:         TokenCacheSize,
+			TokenTTL:          TokenCacheTTL,
+			UserSize:          UserCacheSize,
+			UserTTL:           UserCacheTTL,
+			NegativeSize:      NegativeCacheSize,
+			NegativeTTL:       NegativeCacheTTL,
+			IntrospectionSize: IntrospectionCacheSize,
+			IntrospectionTTL:  IntrospectionCacheTTL,
+		},
+	}
+}
+
+func (auth *Auth) httpClient() *http.Client {
+	if client := auth.Options().HTTPClient; client != nil {
+		return client
+	}
+	return http.DefaultClient
+}
+
+func (auth *Auth) tokenStore() TokenStore {
+	return auth.Options().TokenStore
+}
+
+func (auth *Auth) userStore() UserStore {
+	return auth.Options().UserStore
+}
+
+func (auth *Auth) algorithms() []string {
+	if algorithms := auth.Options().Algorithms; len(algorithms) != 0 {
+		return algorithms
+	}
+	return defaultAlgorithms()
+}
+
+func (auth *Auth) revocationRefreshPeriod() time.Duration {
+	if period := auth.Options().RevocationRefreshPeriod; period > 0 {
+		return period
+	}
+	return time.Minute
+}
+
+func (auth *Auth) tokenExpireGrace() time.Duration {
+	return tokenExpireGrace(auth.Options().TokenExpireGrace)
+}
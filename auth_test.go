@@ -0,0 +1,124 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestAuthInstances(t *testing.T) {
+	type instance struct {
+		signer   *testSigner
+		server   *httptest.Server
+		requests int32
+		auth     *Auth
+	}
+	newInstance := func(kid string, caches CacheConfig) *instance {
+		i := &instance{signer: newTestSigner(t, kid)}
+		i.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/keys" {
+				w.Write(i.signer.body)
+				return
+			}
+			atomic.AddInt32(&i.requests, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":[{"message":"Token not found"}],"status_code":401}`))
+		}))
+		i.auth = NewAuth(Options{AuthOrigin: i.server.URL, UserOrigin: i.server.URL, Caches: caches})
+		return i
+	}
+	a := newInstance("a", CacheConfig{TokenSize: 1})
+	defer a.server.Close()
+	b := newInstance("b", CacheConfig{TokenSize: -1})
+	defer b.server.Close()
+	ctx := context.Background()
+
+	// 公钥
+	for _, i := range []*instance{a, b} {
+		if !i.auth.loadTokenPublicKeysOnce(ctx) {
+			t.Fatal("keys", i.signer.kid)
+		}
+	}
+	if a.auth.loadTokenPublicKeys().Lookup("a", "") == nil || a.auth.loadTokenPublicKeys().Lookup("b", "") != nil {
+		t.Fatal("a keys")
+	}
+	if b.auth.loadTokenPublicKeys().Lookup("b", "") == nil || b.auth.loadTokenPublicKeys().Lookup("a", "") != nil {
+		t.Fatal("b keys")
+	}
+
+	// 上游 使用 自己的 UserOrigin,  其他 实例 签名 的 不请求
+	val := a.signer.token(t, &Token{ID: bson.NewObjectId(), Type: "access", UserID: bson.NewObjectId()}, "")
+	if _, err := a.auth.VerifyToken(ctx, TokenConfig{}, val); err == nil || !isUpstreamRejection(err) {
+		t.Fatal("a upstream", err)
+	}
+	if _, err := b.auth.VerifyToken(ctx, TokenConfig{}, val); err == nil || isUpstreamRejection(err) {
+		t.Fatal("b signature", err)
+	}
+	if atomic.LoadInt32(&a.requests) != 1 || atomic.LoadInt32(&b.requests) != 0 {
+		t.Fatal("origins", a.requests, b.requests)
+	}
+	if a.auth.GetNegativeCacheStats().Len != 1 {
+		t.Fatal("negative cache")
+	}
+
+	// 缓存 大小 来自 Options
+	expiredAt := time.Now().Add(time.Hour)
+	tokens := []*Token{
+		{ID: bson.NewObjectId(), ExpiredAt: &expiredAt},
+		{ID: bson.NewObjectId(), ExpiredAt: &expiredAt},
+	}
+	for _, token := range tokens {
+		a.auth.cacheSetToken(token)
+		b.auth.cacheSetToken(token)
+	}
+	if _, ok := a.auth.cacheGetToken(tokens[1].ID.Hex()); !ok {
+		t.Fatal("a cache")
+	}
+	if stats := a.auth.GetTokenCacheStats(); stats.Len != 1 || stats.Size != 1 {
+		t.Fatal("a cache stats", stats)
+	}
+	if _, ok := b.auth.cacheGetToken(tokens[1].ID.Hex()); ok {
+		t.Fatal("b cache disabled")
+	}
+	if stats := defaultAuth.GetTokenCacheStats(); stats.Size != TokenCacheSize {
+		t.Fatal("default cache stats", stats)
+	}
+}
+
+func TestAuthOptionsAlgorithms(t *testing.T) {
+	signer := newTestSigner(t, "key")
+	a, _, aToken := newTestAuth(t, signer, Options{})
+	b, _, bToken := newTestAuth(t, signer, Options{Algorithms: []string{"ES256"}, DPoP: DPoPConfig{Algorithms: []string{"ES256"}, ReplayCacheSize: 1}})
+	ctx := context.Background()
+
+	// 默认 允许 EdDSA
+	if _, err := a.VerifyToken(ctx, TokenConfig{Cache: true}, signer.token(t, aToken, "")); err != nil {
+		t.Fatal("a", err)
+	}
+	if _, err := b.VerifyToken(ctx, TokenConfig{Cache: true}, signer.token(t, bToken, "")); err == nil {
+		t.Fatal("b algorithm")
+	}
+
+	header := http.Header{}
+	b.Options().DPoP.withDefaults().challenge(header)
+	if header.Get("WWW-Authenticate") != `DPoP algs="ES256"` {
+		t.Fatal("b challenge", header)
+	}
+
+	// DPoP 重放 缓存 每个 实例 一个
+	now := time.Now()
+	if !b.dpopReplay.add("jti", now.Add(time.Minute), now, b.Options().DPoP.withDefaults().ReplayCacheSize) {
+		t.Fatal("b replay")
+	}
+	if b.dpopReplay.add("other", now.Add(time.Minute), now, b.Options().DPoP.withDefaults().ReplayCacheSize) {
+		t.Fatal("b replay full")
+	}
+	if !a.dpopReplay.add("jti", now.Add(time.Minute), now, a.Options().DPoP.withDefaults().ReplayCacheSize) {
+		t.Fatal("a replay")
+	}
+}
@@ -0,0 +1,356 @@
+package model
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/otamoe/gin-server/errs"
+	mgoModel "github.com/otamoe/mgo-model"
+)
+
+type (
+	// 进程内 LRU 缓存 的 大小 和 时间,  0 使用 默认 10000 个,  token 用户 1 分钟,  negative 30 秒,  内省 5 分钟.  小于 0 不缓存
+	CacheConfig struct {
+		TokenSize         int
+		TokenTTL          time.Duration
+		UserSize          int
+		UserTTL           time.Duration
+		NegativeSize      int
+		NegativeTTL       time.Duration
+		IntrospectionSize int
+		IntrospectionTTL  time.Duration
+	}
+
+	CacheStats struct {
+		Hits   uint64 `json:"hits"`
+		Misses uint64 `json:"misses"`
+		Len    int    `json:"len"`
+		Size   int    `json:"size"`
+	}
+
+	lruCache struct {
+		sync.Mutex
+		size   int
+		ttl    time.Duration
+		list   *list.List
+		items  map[string]*list.Element
+		hits   uint64
+		misses uint64
+	}
+
+	lruEntry struct {
+		key       string
+		value     interface{}
+		expiredAt time.Time
+	}
+
+	authCaches struct {
+		token     *lruCache
+		tokenOnce sync.Once
+		user      *lruCache
+		userOnce  sync.Once
+
+		// 没有被撤销的 token,  和 token 缓存 一样的 大小 时间
+		revocation     *lruCache
+		revocationOnce sync.Once
+
+		// 被拒绝的 token,  key 是 sha256
+		negative     *lruCache
+		negativeOnce sync.Once
+
+		// 内省 结果,  key 是 sha256
+		introspection     *lruCache
+		introspectionOnce sync.Once
+	}
+)
+
+func (c CacheConfig) withDefaults() CacheConfig {
+	defaultInt := func(value *int, d int) {
+		if *value == 0 {
+			*value = d
+		}
+	}
+	defaultDuration := func(value *time.Duration, d time.Duration) {
+		if *value == 0 {
+			*value = d
+		}
+	}
+	defaultInt(&c.TokenSize, 10000)
+	defaultDuration(&c.TokenTTL, time.Minute)
+	defaultInt(&c.UserSize, 10000)
+	defaultDuration(&c.UserTTL, time.Minute)
+	defaultInt(&c.NegativeSize, 10000)
+	defaultDuration(&c.NegativeTTL, time.Second*30)
+	defaultInt(&c.IntrospectionSize, 10000)
+	defaultDuration(&c.IntrospectionTTL, time.Minute*5)
+	return c
+}
+
+// size <= 0 不缓存
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:  size,
+		ttl:   ttl,
+		list:  list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (cache *lruCache) Get(key string) (value interface{}, ok bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	var element *list.Element
+	if element, ok = cache.items[key]; ok {
+		entry := element.Value.(*lruEntry)
+		if entry.expiredAt.After(time.Now()) {
+			cache.list.MoveToFront(element)
+			atomic.AddUint64(&cache.hits, 1)
+			value = entry.value
+			return
+		}
+		cache.list.Remove(element)
+		delete(cache.items, key)
+		ok = false
+	}
+	atomic.AddUint64(&cache.misses, 1)
+	return
+}
+
+// expiredAt 为空 或 晚于 ttl  使用 ttl
+func (cache *lruCache) Set(key string, value interface{}, expiredAt *time.Time) {
+	if cache.size <= 0 || cache.ttl <= 0 {
+		return
+	}
+	entry := &lruEntry{
+		key:       key,
+		value:     value,
+		expiredAt: time.Now().Add(cache.ttl),
+	}
+	if expiredAt != nil && expiredAt.Before(entry.expiredAt) {
+		entry.expiredAt = *expiredAt
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	if element, ok := cache.items[key]; ok {
+		element.Value = entry
+		cache.list.MoveToFront(element)
+		return
+	}
+	cache.items[key] = cache.list.PushFront(entry)
+	for cache.list.Len() > cache.size {
+		element := cache.list.Back()
+		cache.list.Remove(element)
+		delete(cache.items, element.Value.(*lruEntry).key)
+	}
+}
+
+func (cache *lruCache) Delete(key string) {
+	cache.Lock()
+	defer cache.Unlock()
+	if element, ok := cache.items[key]; ok {
+		cache.list.Remove(element)
+		delete(cache.items, key)
+	}
+}
+
+// fn 返回 新的 值 替换,  返回 nil 不修改.  不改变 顺序 和 过期时间
+func (cache *lruCache) Update(fn func(value interface{}) interface{}) {
+	cache.Lock()
+	defer cache.Unlock()
+	for element := cache.list.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*lruEntry)
+		if value := fn(entry.value); value != nil {
+			element.Value = &lruEntry{key: entry.key, value: value, expiredAt: entry.expiredAt}
+		}
+	}
+}
+
+func (cache *lruCache) Purge() {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.list.Init()
+	cache.items = map[string]*list.Element{}
+}
+
+func (cache *lruCache) Stats() CacheStats {
+	cache.Lock()
+	defer cache.Unlock()
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&cache.hits),
+		Misses: atomic.LoadUint64(&cache.misses),
+		Len:    cache.list.Len(),
+		Size:   cache.size,
+	}
+}
+
+// 第一次使用时 读取 Options().Caches
+func (auth *Auth) getTokenCache() *lruCache {
+	caches := &auth.caches
+	caches.tokenOnce.Do(func() {
+		c := auth.Options().Caches.withDefaults()
+		caches.token = newLRUCache(c.TokenSize, c.TokenTTL)
+	})
+	return caches.token
+}
+
+func (auth *Auth) getUserCache() *lruCache {
+	caches := &auth.caches
+	caches.userOnce.Do(func() {
+		c := auth.Options().Caches.withDefaults()
+		caches.user = newLRUCache(c.UserSize, c.UserTTL)
+	})
+	return caches.user
+}
+
+func (auth *Auth) getRevocationCache() *lruCache {
+	caches := &auth.caches
+	caches.revocationOnce.Do(func() {
+		c := auth.Options().Caches.withDefaults()
+		caches.revocation = newLRUCache(c.TokenSize, c.TokenTTL)
+	})
+	return caches.revocation
+}
+
+func (auth *Auth) getNegativeCache() *lruCache {
+	caches := &auth.caches
+	caches.negativeOnce.Do(func() {
+		c := auth.Options().Caches.withDefaults()
+		caches.negative = newLRUCache(c.NegativeSize, c.NegativeTTL)
+	})
+	return caches.negative
+}
+
+func (auth *Auth) getIntrospectionCache() *lruCache {
+	caches := &auth.caches
+	caches.introspectionOnce.Do(func() {
+		c := auth.Options().Caches.withDefaults()
+		caches.introspection = newLRUCache(c.IntrospectionSize, c.IntrospectionTTL)
+	})
+	return caches.introspection
+}
+
+func GetTokenCacheStats() CacheStats {
+	return defaultAuth.GetTokenCacheStats()
+}
+
+func GetUserCacheStats() CacheStats {
+	return defaultAuth.GetUserCacheStats()
+}
+
+func GetNegativeCacheStats() CacheStats {
+	return defaultAuth.GetNegativeCacheStats()
+}
+
+func (auth *Auth) GetTokenCacheStats() CacheStats {
+	return auth.getTokenCache().Stats()
+}
+
+func (auth *Auth) GetUserCacheStats() CacheStats {
+	return auth.getUserCache().Stats()
+}
+
+func (auth *Auth) GetNegativeCacheStats() CacheStats {
+	return auth.getNegativeCache().Stats()
+}
+
+// 缓存里 保存副本,  不能引用 请求的 context
+func (auth *Auth) cacheGetToken(id string) (token *Token, ok bool) {
+	var value interface{}
+	if value, ok = auth.getTokenCache().Get(id); ok {
+		token = value.(*Token).clone()
+	}
+	return
+}
+
+func (auth *Auth) cacheSetToken(token *Token) {
+	if token == nil || !token.ID.Valid() {
+		return
+	}
+	auth.getTokenCache().Set(token.ID.Hex(), token.clone(), token.ExpiredAt)
+}
+
+func (auth *Auth) cacheGetUser(id string) (user *User, ok bool) {
+	var value interface{}
+	if value, ok = auth.getUserCache().Get(id); ok {
+		user = value.(*User).clone()
+	}
+	return
+}
+
+func (auth *Auth) cacheSetUser(user *User) {
+	if user == nil || !user.ID.Valid() {
+		return
+	}
+	auth.getUserCache().Set(user.ID.Hex(), user.clone(), nil)
+}
+
+// 用户 刷新 后 缓存的 token 使用 新的 用户,  不然 每次 命中 都会 再 刷新
+func (auth *Auth) cacheSetTokenUser(user *User) {
+	auth.getTokenCache().Update(func(value interface{}) interface{} {
+		token := value.(*Token)
+		if token.UserID != user.ID {
+			return nil
+		}
+		token = token.clone()
+		token.User = user.clone()
+		return token
+	})
+}
+
+func negativeCacheKey(val string) string {
+	sum := sha256.Sum256([]byte(val))
+	return hex.EncodeToString(sum[:])
+}
+
+func (auth *Auth) negativeCacheGet(val string) (err error, ok bool) {
+	var value interface{}
+	if value, ok = auth.getNegativeCache().Get(negativeCacheKey(val)); ok {
+		err = value.(error)
+	}
+	return
+}
+
+func (auth *Auth) negativeCacheSet(val string, err error) {
+	auth.getNegativeCache().Set(negativeCacheKey(val), err, nil)
+}
+
+// 签名错误
+func isTokenSignatureError(err error) bool {
+	if e, ok := err.(*errs.Error); ok {
+		err = e.Err
+	}
+	if validationError, ok := err.(*jwt.ValidationError); ok {
+		return validationError.Errors&(jwt.ValidationErrorMalformed|jwt.ValidationErrorSignatureInvalid) != 0
+	}
+	return false
+}
+
+// 上游 401 404
+func isUpstreamRejection(err error) bool {
+	if e, ok := err.(*errs.Error); ok {
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+func (token *Token) clone() *Token {
+	value := *token
+	value.DocumentBase = mgoModel.DocumentBase{}
+	if value.User != nil {
+		value.User = value.User.clone()
+	}
+	return &value
+}
+
+func (user *User) clone() *User {
+	value := *user
+	value.DocumentBase = mgoModel.DocumentBase{}
+	return &value
+}
@@ -0,0 +1,154 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestLRUCache(t *testing.T) {
+	cache := newLRUCache(2, time.Minute)
+	cache.Set("a", 1, nil)
+	cache.Set("b", 2, nil)
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("a")
+	}
+	// b 最久没有使用
+	cache.Set("c", 3, nil)
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("b not evicted")
+	}
+	expiredAt := time.Now().Add(-time.Second)
+	cache.Set("d", 4, &expiredAt)
+	if _, ok := cache.Get("d"); ok {
+		t.Fatal("d expired")
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Fatal("Stats", stats)
+	}
+}
+
+func TestCacheToken(t *testing.T) {
+	expiredAt := time.Now().Add(time.Hour)
+	token := &Token{
+		ID:        bson.NewObjectId(),
+		UserID:    bson.NewObjectId(),
+		ExpiredAt: &expiredAt,
+		User:      &User{Username: "name"},
+	}
+	auth := NewAuth(Options{})
+	auth.cacheSetToken(token)
+	cached, ok := auth.cacheGetToken(token.ID.Hex())
+	if !ok || cached.UserID != token.UserID {
+		t.Fatal("cacheGetToken", cached)
+	}
+	// 副本
+	cached.User.Username = "other"
+	if cached, _ = auth.cacheGetToken(token.ID.Hex()); cached.User.Username != "name" {
+		t.Fatal("cacheGetToken shared", cached.User)
+	}
+	// 实例 之间 不共享
+	if _, ok = defaultAuth.cacheGetToken(token.ID.Hex()); ok {
+		t.Fatal("cacheGetToken other auth")
+	}
+}
+
+func TestUserStaleness(t *testing.T) {
+	now := time.Now()
+	fetchedAt := now.Add(-time.Minute * 2)
+	user := &User{FetchedAt: &fetchedAt}
+	if v := user.staleness(0, 0, now); v != userFresh {
+		t.Fatal("no limit", v)
+	}
+	if v := user.staleness(time.Minute*5, time.Hour, now); v != userFresh {
+		t.Fatal("fresh", v)
+	}
+	if v := user.staleness(time.Minute, time.Hour, now); v != userStale {
+		t.Fatal("stale", v)
+	}
+	if v := user.staleness(time.Minute, time.Minute, now); v != userExpired {
+		t.Fatal("expired", v)
+	}
+	// 旧数据 没有 FetchedAt
+	if v := (&User{}).staleness(time.Minute, 0, now); v != userStale {
+		t.Fatal("legacy", v)
+	}
+}
+
+func TestRefreshTokenUser(t *testing.T) {
+	var requests int32
+	var userID bson.ObjectId
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		json.NewEncoder(w).Encode(&User{ID: userID, Username: "fresh"})
+	}))
+	defer server.Close()
+	signer := newTestSigner(t, "key")
+	auth, store, token := newTestAuth(t, signer, Options{UserOrigin: server.URL})
+	userID = token.UserID
+	fetchedAt := time.Now().Add(-time.Hour)
+	store.users[userID].FetchedAt = &fetchedAt
+	val := signer.token(t, token, "")
+	c := TokenConfig{Cache: true, UserMaxAge: time.Minute}
+
+	// 旧 用户 后台 刷新
+	if found, err := auth.VerifyToken(context.Background(), c, val); err != nil || found.User.Username != "a" {
+		t.Fatal("VerifyToken", found, err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := auth.userRefreshing.Load(userID.Hex()); !ok && atomic.LoadInt32(&requests) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// 缓存的 token 已经 是 新 用户,  不会 再 刷新
+	for i := 0; i < 5; i++ {
+		if found, err := auth.VerifyToken(context.Background(), c, val); err != nil || found.User.Username != "fresh" {
+			t.Fatal("VerifyToken fresh", found, err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatal("requests", n)
+	}
+}
+
+// Stop 取消 并 等待 后台 刷新
+func TestRefreshUserBackgroundStop(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second * 5):
+		}
+	}))
+	defer server.Close()
+	signer := newTestSigner(t, "key")
+	auth, store, token := newTestAuth(t, signer, Options{UserOrigin: server.URL})
+	handle := auth.Start()
+
+	auth.refreshUserBackground(context.Background(), token.UserID.Hex())
+	select {
+	case <-requested:
+	case <-time.After(time.Second):
+		t.Fatal("request")
+	}
+	start := time.Now()
+	handle.Stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("Stop", elapsed)
+	}
+	if _, ok := auth.userRefreshing.Load(token.UserID.Hex()); ok {
+		t.Fatal("refreshing")
+	}
+	if user, err := store.FindUser(context.Background(), token.UserID); err != nil || user.Username != "a" {
+		t.Fatal("user", user, err)
+	}
+}
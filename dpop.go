@@ -0,0 +1,347 @@
+package model
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/otamoe/gin-server/errs"
+)
+
+// RFC 9449
+type (
+	TokenConfirmation struct {
+		// DPoP JWK SHA-256 thumbprint
+		JKT string `json:"jkt,omitempty"`
+		// 客户端证书 SHA-256 thumbprint  RFC 8705
+		X5TS256 string `json:"x5t#S256,omitempty"`
+	}
+
+	DPoPClaims struct {
+		HTM   string `json:"htm"`
+		HTU   string `json:"htu"`
+		ATH   string `json:"ath,omitempty"`
+		Nonce string `json:"nonce,omitempty"`
+		jwt.StandardClaims
+	}
+
+	// proof 允许的算法 和 有效期,  0 使用 默认 5 分钟,  重放缓存 100000 个
+	DPoPConfig struct {
+		// nil 是 ES256 ES384 ES512 RS256 PS256 EdDSA
+		Algorithms      []string
+		ProofTTL        time.Duration
+		NonceTTL        time.Duration
+		ReplayCacheSize int
+	}
+
+	// 使用过的 proof jti
+	dpopReplay struct {
+		sync.Mutex
+		values map[string]time.Time
+	}
+)
+
+var dpopNonceSecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}()
+
+func (c DPoPConfig) withDefaults() DPoPConfig {
+	if len(c.Algorithms) == 0 {
+		c.Algorithms = defaultAlgorithms()
+	}
+	if c.ProofTTL <= 0 {
+		c.ProofTTL = time.Minute * 5
+	}
+	if c.NonceTTL <= 0 {
+		c.NonceTTL = time.Minute * 5
+	}
+	if c.ReplayCacheSize <= 0 {
+		c.ReplayCacheSize = 100000
+	}
+	return c
+}
+
+// header 是 响应 header,  可以是 nil
+func (c DPoPConfig) error(header http.Header, errorCode string, description string) error {
+	if header != nil {
+		header.Set("WWW-Authenticate", fmt.Sprintf(`DPoP error="%s", error_description="%s", algs="%s"`, errorCode, description, strings.Join(c.Algorithms, " ")))
+	}
+	return &errs.Error{
+		Message:    description,
+		Path:       "dpop",
+		Type:       errorCode,
+		StatusCode: http.StatusUnauthorized,
+	}
+}
+
+func (c DPoPConfig) challenge(header http.Header) {
+	if header.Get("WWW-Authenticate") == "" {
+		header.Set("WWW-Authenticate", fmt.Sprintf(`DPoP algs="%s"`, strings.Join(c.Algorithms, " ")))
+	}
+}
+
+// 没有 request 当作 Bearer
+func (auth *Auth) checkDPoP(request *http.Request, header http.Header, c TokenConfig, val string, claims *TokenClaims) (err error) {
+	dpop := auth.Options().DPoP.withDefaults()
+	var jkt string
+	if claims.Confirmation != nil {
+		jkt = claims.Confirmation.JKT
+	}
+	var authorization string
+	if request != nil {
+		authorization = request.Header.Get("Authorization")
+	}
+	isDPoP := len(authorization) > 5 && strings.ToLower(authorization[:5]) == "dpop "
+
+	if !isDPoP {
+		// 绑定的 token 不能当 Bearer 使用
+		if jkt != "" || c.DPoPRequired {
+			err = dpop.error(header, "invalid_token", "DPoP bound token requires the DPoP authorization scheme")
+		}
+		return
+	}
+	if jkt == "" {
+		err = dpop.error(header, "invalid_token", "Token is not DPoP bound")
+		return
+	}
+
+	proofs := request.Header.Values("DPoP")
+	if len(proofs) != 1 {
+		err = dpop.error(header, "invalid_dpop_proof", "Exactly one DPoP proof is required")
+		return
+	}
+
+	var thumbprint string
+	dpopClaims := &DPoPClaims{}
+	parser := &jwt.Parser{ValidMethods: dpop.Algorithms, SkipClaimsValidation: true}
+	if _, err = parser.ParseWithClaims(proofs[0], dpopClaims, func(jwtToken *jwt.Token) (key interface{}, err error) {
+		if typ, _ := jwtToken.Header["typ"].(string); typ != "dpop+jwt" {
+			err = fmt.Errorf("DPoP proof typ is invalid")
+			return
+		}
+		var publicKey *TokenPublicKey
+		if publicKey, err = parseDPoPJWK(jwtToken.Header["jwk"]); err != nil {
+			return
+		}
+		if !publicKey.AllowAlgorithm(jwtToken.Method.Alg()) {
+			err = ErrTokenAlgorithm
+			return
+		}
+		if thumbprint, err = publicKey.Thumbprint(); err != nil {
+			return
+		}
+		key = publicKey.PublicKey
+		return
+	}); err != nil {
+		err = dpop.error(header, "invalid_dpop_proof", "DPoP proof is invalid")
+		return
+	}
+
+	if !strings.EqualFold(dpopClaims.HTM, request.Method) {
+		err = dpop.error(header, "invalid_dpop_proof", "DPoP proof htm mismatch")
+		return
+	}
+	if !dpopMatchURL(request, dpopClaims.HTU, c.DPoPTrustForwarded) {
+		err = dpop.error(header, "invalid_dpop_proof", "DPoP proof htu mismatch")
+		return
+	}
+
+	now := time.Now()
+	iat := time.Unix(dpopClaims.IssuedAt, 0)
+	if dpopClaims.IssuedAt == 0 || iat.After(now.Add(c.ClockSkew)) || iat.Before(now.Add(-dpop.ProofTTL-c.ClockSkew)) {
+		err = dpop.error(header, "invalid_dpop_proof", "DPoP proof iat is out of range")
+		return
+	}
+
+	ath := sha256.Sum256([]byte(val))
+	if dpopClaims.ATH != base64.RawURLEncoding.EncodeToString(ath[:]) {
+		err = dpop.error(header, "invalid_dpop_proof", "DPoP proof ath mismatch")
+		return
+	}
+	if thumbprint != jkt {
+		err = dpop.error(header, "invalid_token", "DPoP proof key does not match token")
+		return
+	}
+
+	if c.DPoPNonce && !dpopValidNonce(dpopClaims.Nonce, now, dpop.NonceTTL) {
+		if header != nil {
+			header.Set("DPoP-Nonce", dpopNewNonce(now))
+		}
+		err = dpop.error(header, "use_dpop_nonce", "Authorization server requires nonce in DPoP proof")
+		return
+	}
+
+	// 重放
+	if dpopClaims.Id == "" || !auth.dpopReplay.add(jkt+"."+dpopClaims.Id, iat.Add(dpop.ProofTTL+c.ClockSkew*2), now, dpop.ReplayCacheSize) {
+		err = dpop.error(header, "invalid_dpop_proof", "DPoP proof jti has been used")
+		return
+	}
+	return
+}
+
+func parseDPoPJWK(value interface{}) (publicKey *TokenPublicKey, err error) {
+	jwk, ok := value.(map[string]interface{})
+	if !ok {
+		err = fmt.Errorf("DPoP proof jwk is required")
+		return
+	}
+	// 不能是 私钥 或 对称 key
+	if _, ok = jwk["d"]; ok {
+		err = fmt.Errorf("DPoP proof jwk is a private key")
+		return
+	}
+	var jwkBytes []byte
+	if jwkBytes, err = json.Marshal(jwk); err != nil {
+		return
+	}
+	publicKey = &TokenPublicKey{}
+	if err = json.Unmarshal(jwkBytes, publicKey); err != nil {
+		return
+	}
+	if publicKey.KeyType == "oct" || len(publicKey.PublicKeyBytes) != 0 {
+		err = ErrTokenPublicKeyUnsupported
+		return
+	}
+	if err = publicKey.parse(); err != nil {
+		return
+	}
+	return
+}
+
+// JWK SHA-256 thumbprint  RFC 7638
+func (publicKey *TokenPublicKey) Thumbprint() (thumbprint string, err error) {
+	var value interface{}
+	switch publicKey.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		value = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{publicKey.Curve, "EC", publicKey.X, publicKey.Y}
+	case *rsa.PublicKey:
+		value = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{publicKey.E, "RSA", publicKey.N}
+	case ed25519.PublicKey:
+		value = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{publicKey.Curve, "OKP", publicKey.X}
+	default:
+		err = ErrTokenPublicKeyUnsupported
+		return
+	}
+	var valueBytes []byte
+	if valueBytes, err = json.Marshal(value); err != nil {
+		return
+	}
+	sum := sha256.Sum256(valueBytes)
+	thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+	return
+}
+
+// trustForwarded 为 false 时 客户端 不能 通过 X-Forwarded-* 选择 htu
+func dpopMatchURL(request *http.Request, htu string, trustForwarded bool) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	host := request.Host
+	if trustForwarded {
+		if proto := request.Header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+		}
+		if forwardedHost := request.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+			host = strings.TrimSpace(strings.Split(forwardedHost, ",")[0])
+		}
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	return strings.EqualFold(u.Scheme, scheme) && strings.EqualFold(dpopHost(u.Scheme, u.Host), dpopHost(scheme, host)) && path == request.URL.Path
+}
+
+// 去掉 默认端口
+func dpopHost(scheme string, host string) string {
+	scheme = strings.ToLower(scheme)
+	if scheme == "https" {
+		return strings.TrimSuffix(host, ":443")
+	}
+	if scheme == "http" {
+		return strings.TrimSuffix(host, ":80")
+	}
+	return host
+}
+
+func (replay *dpopReplay) add(key string, expiredAt time.Time, now time.Time, size int) bool {
+	replay.Lock()
+	defer replay.Unlock()
+	if replay.values == nil {
+		replay.values = map[string]time.Time{}
+	}
+	if old, ok := replay.values[key]; ok && old.After(now) {
+		return false
+	}
+	if len(replay.values) >= size {
+		for k, v := range replay.values {
+			if !v.After(now) {
+				delete(replay.values, k)
+			}
+		}
+	}
+	// 满了 拒绝  不能 清除 否则可以重放
+	if len(replay.values) >= size {
+		return false
+	}
+	replay.values[key] = expiredAt
+	return true
+}
+
+// 无状态 nonce  时间 + HMAC
+func dpopNewNonce(now time.Time) string {
+	value := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(value, uint64(now.Unix()))
+	mac := hmac.New(sha256.New, dpopNonceSecret)
+	mac.Write(value)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(value))
+}
+
+func dpopValidNonce(nonce string, now time.Time, ttl time.Duration) bool {
+	value, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(value) != 8+sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, dpopNonceSecret)
+	mac.Write(value[:8])
+	if !hmac.Equal(mac.Sum(nil), value[8:]) {
+		return false
+	}
+	issuedAt := time.Unix(int64(binary.BigEndian.Uint64(value[:8])), 0)
+	return !issuedAt.After(now) && now.Sub(issuedAt) <= ttl
+}
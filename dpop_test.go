@@ -0,0 +1,124 @@
+package model
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestCheckDPoP(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := map[string]interface{}{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(privateKey.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(privateKey.Y.FillBytes(make([]byte, 32))),
+	}
+	publicKey, err := parseDPoPJWK(jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jkt, err := publicKey.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accessToken := "access-token"
+	ath := sha256.Sum256([]byte(accessToken))
+	proof := func(htu string, ath []byte, nonce string) string {
+		jwtToken := jwt.NewWithClaims(jwt.SigningMethodES256, &DPoPClaims{
+			HTM:   "GET",
+			HTU:   htu,
+			ATH:   base64.RawURLEncoding.EncodeToString(ath),
+			Nonce: nonce,
+			StandardClaims: jwt.StandardClaims{
+				Id:       bson.NewObjectId().Hex(),
+				IssuedAt: time.Now().Unix(),
+			},
+		})
+		jwtToken.Header["typ"] = "dpop+jwt"
+		jwtToken.Header["jwk"] = jwk
+		val, err := jwtToken.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return val
+	}
+	check := func(scheme string, dpop string, c TokenConfig) (*httptest.ResponseRecorder, error) {
+		recorder := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(recorder)
+		ctx.Request = httptest.NewRequest("GET", "https://api.example.com/resource?a=1", nil)
+		ctx.Request.Header.Set("Authorization", scheme+" "+accessToken)
+		if dpop != "" {
+			ctx.Request.Header.Set("DPoP", dpop)
+		}
+		claims := &TokenClaims{Confirmation: &TokenConfirmation{JKT: jkt}}
+		return recorder, defaultAuth.checkDPoP(ctx.Request, recorder.Header(), c, accessToken, claims)
+	}
+
+	c := TokenConfig{DPoP: true}
+	val := proof("https://api.example.com/resource", ath[:], "")
+	if _, err = check("DPoP", val, c); err != nil {
+		t.Fatal(err)
+	}
+	// 重放
+	if _, err = check("DPoP", val, c); err == nil {
+		t.Fatal("replay")
+	}
+	if _, err = check("DPoP", proof("https://api.example.com/other", ath[:], ""), c); err == nil {
+		t.Fatal("htu")
+	}
+	if _, err = check("DPoP", proof("https://api.example.com/resource", []byte("other"), ""), c); err == nil {
+		t.Fatal("ath")
+	}
+	recorder, err := check("Bearer", "", c)
+	if err == nil {
+		t.Fatal("bearer")
+	}
+	if !strings.HasPrefix(recorder.Header().Get("WWW-Authenticate"), "DPoP ") {
+		t.Fatal("WWW-Authenticate", recorder.Header())
+	}
+
+	// nonce
+	c.DPoPNonce = true
+	recorder, err = check("DPoP", proof("https://api.example.com/resource", ath[:], ""), c)
+	nonce := recorder.Header().Get("DPoP-Nonce")
+	if err == nil || nonce == "" {
+		t.Fatal("nonce required")
+	}
+	if _, err = check("DPoP", proof("https://api.example.com/resource", ath[:], nonce), c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDPoPMatchURL(t *testing.T) {
+	request := httptest.NewRequest("GET", "http://10.0.0.1:8080/resource?a=1", nil)
+	request.Header.Set("X-Forwarded-Proto", "https")
+	request.Header.Set("X-Forwarded-Host", "api.example.com")
+	if !dpopMatchURL(request, "http://10.0.0.1:8080/resource", false) {
+		t.Fatal("request url")
+	}
+	// 没有 开启 时 客户端 不能 选择 htu
+	if dpopMatchURL(request, "https://api.example.com/resource", false) {
+		t.Fatal("forwarded without trust")
+	}
+	if !dpopMatchURL(request, "https://api.example.com:443/resource", true) {
+		t.Fatal("forwarded")
+	}
+	if dpopMatchURL(request, "http://10.0.0.1:8080/resource", true) {
+		t.Fatal("request url with trust")
+	}
+}
@@ -0,0 +1,61 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+type (
+	// 同一个 key 并发调用 只执行一次
+	flightGroup struct {
+		sync.Mutex
+		calls map[string]*flightCall
+	}
+
+	flightCall struct {
+		wg    sync.WaitGroup
+		value interface{}
+		err   error
+		dups  int
+	}
+)
+
+func (group *flightGroup) Do(key string, fn func() (interface{}, error)) (value interface{}, err error, shared bool) {
+	group.Lock()
+	if group.calls == nil {
+		group.calls = map[string]*flightCall{}
+	}
+	if call, ok := group.calls[key]; ok {
+		call.dups++
+		group.Unlock()
+		call.wg.Wait()
+		return call.value, call.err, true
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	group.calls[key] = call
+	group.Unlock()
+
+	defer func() {
+		group.Lock()
+		delete(group.calls, key)
+		shared = call.dups != 0
+		group.Unlock()
+		call.wg.Done()
+	}()
+	call.value, call.err = fn()
+	return call.value, call.err, false
+}
+
+// 共享的 调用 因为 其他 请求 取消 或 超时 失败,  ctx 还有效 时 自己 再执行 一次
+func (group *flightGroup) DoContext(ctx context.Context, key string, fn func() (interface{}, error)) (value interface{}, err error, shared bool) {
+	if value, err, shared = group.Do(key, fn); !shared || err == nil {
+		return
+	}
+	if (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) && upstreamContext(ctx).Err() == nil {
+		value, err = fn()
+		shared = false
+	}
+	return
+}
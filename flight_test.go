@@ -0,0 +1,112 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestFlightGroup(t *testing.T) {
+	group := &flightGroup{}
+	var calls int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err, _ := group.Do("key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(time.Millisecond * 50)
+				return 1, nil
+			})
+			if err != nil || value != 1 {
+				t.Error("Do", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatal("calls", n)
+	}
+
+	// 共享的 调用 因为 其他 请求 取消 失败,  自己 再执行
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	started := make(chan struct{})
+	go group.DoContext(canceled, "cancel", func() (interface{}, error) {
+		close(started)
+		time.Sleep(time.Millisecond * 50)
+		return nil, canceled.Err()
+	})
+	<-started
+	value, err, shared := group.DoContext(context.Background(), "cancel", func() (interface{}, error) {
+		return 2, nil
+	})
+	if err != nil || value != 2 || shared {
+		t.Fatal("DoContext", value, err, shared)
+	}
+}
+
+func TestVerifyTokenFlight(t *testing.T) {
+	signer := newTestSigner(t, "key")
+	expiredAt := time.Now().Add(time.Hour)
+	token := &Token{ID: bson.NewObjectId(), Type: "access", UserID: bson.NewObjectId(), ExpiredAt: &expiredAt}
+	token.User = &User{ID: token.UserID, Username: "a"}
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(time.Millisecond * 100)
+		json.NewEncoder(w).Encode(token)
+	}))
+	defer server.Close()
+	store := NewMemoryStore()
+	auth := NewAuth(Options{UserOrigin: server.URL, TokenStore: store, UserStore: store})
+	auth.keys.publicKeys.Store(signer.publicKeys)
+	val := signer.token(t, token, "")
+
+	// Cache 不同 的 调用 不共享
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(cache bool) {
+			defer wg.Done()
+			value, err := auth.VerifyToken(context.Background(), TokenConfig{Cache: cache}, val)
+			if err != nil || value.ID != token.ID || value.User.Username != "a" {
+				t.Error("VerifyToken", value, err)
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatal("requests", n)
+	}
+
+	// 重复 写入 结果 一样
+	if len(store.tokens) != 1 || len(store.users) != 1 {
+		t.Fatal("store", len(store.tokens), len(store.users))
+	}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.UpsertUser(context.Background(), &User{ID: token.UserID, Username: "b"}); err != nil {
+				t.Error(err)
+			}
+			if err := store.InsertToken(context.Background(), &Token{ID: token.ID, Type: "other"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	found, err := store.FindToken(context.Background(), token.ID)
+	if err != nil || found.Type != "access" || found.User.Username != "b" || len(store.users) != 1 {
+		t.Fatal("FindToken", found, err)
+	}
+}
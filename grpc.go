@@ -0,0 +1,182 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/otamoe/gin-server/errs"
+	ginResource "github.com/otamoe/gin-server/resource"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type (
+	GRPCConfig struct {
+		TokenConfig
+
+		// 不为空 并且 返回的 resource 不为空 时 用 Token.ValidateScope 检查
+		Resource func(ctx context.Context, fullMethod string) *ginResource.Resource
+	}
+
+	grpcServerStream struct {
+		grpc.ServerStream
+		ctx context.Context
+	}
+)
+
+// "/package.Service/Method"  type 是 package.Service,  action 是 Method
+func MethodResource(application bson.ObjectId) func(ctx context.Context, fullMethod string) *ginResource.Resource {
+	return func(ctx context.Context, fullMethod string) *ginResource.Resource {
+		service, method := fullMethod, ""
+		if i := strings.LastIndex(fullMethod, "/"); i != -1 {
+			service, method = fullMethod[:i], fullMethod[i+1:]
+		}
+		return &ginResource.Resource{
+			Application: application,
+			Type:        strings.TrimPrefix(service, "/"),
+			Action:      method,
+			Params:      map[string]interface{}{},
+		}
+	}
+}
+
+func UnaryServerInterceptor(c GRPCConfig) grpc.UnaryServerInterceptor {
+	return defaultAuth.UnaryServerInterceptor(c)
+}
+
+func (auth *Auth) UnaryServerInterceptor(c GRPCConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		if ctx, err = c.authenticate(auth, ctx, info.FullMethod); err != nil {
+			return
+		}
+		return handler(ctx, req)
+	}
+}
+
+func StreamServerInterceptor(c GRPCConfig) grpc.StreamServerInterceptor {
+	return defaultAuth.StreamServerInterceptor(c)
+}
+
+func (auth *Auth) StreamServerInterceptor(c GRPCConfig) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		var ctx context.Context
+		if ctx, err = c.authenticate(auth, stream.Context(), info.FullMethod); err != nil {
+			return
+		}
+		return handler(srv, &grpcServerStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+func (stream *grpcServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (c GRPCConfig) authenticate(auth *Auth, ctx context.Context, fullMethod string) (_ context.Context, err error) {
+	request := grpcRequest(ctx, fullMethod)
+	var token *Token
+	if token, err = auth.VerifyRequest(ctx, c.TokenConfig, request, nil); err == nil && token == nil && c.Required {
+		err = ErrTokenNotFound
+	}
+	auth.metrics.tokenResult(token, err)
+	if err != nil {
+		err = GRPCError(unauthorizedError(err))
+		return
+	}
+	if token != nil {
+		ctx = NewContextWithToken(ctx, token)
+		if token.User != nil {
+			ctx = NewContextWithUser(ctx, token.User)
+		}
+	}
+
+	if c.Resource != nil {
+		if resource := c.Resource(ctx, fullMethod); resource != nil {
+			if token == nil {
+				err = GRPCError(ErrTokenNotFound)
+				return
+			}
+			if _, err = token.ValidateScopeContext(ctx, resource); err != nil {
+				err = GRPCError(err)
+				return
+			}
+		}
+	}
+	return ctx, nil
+}
+
+// gRPC 是 HTTP/2 POST,  metadata 当作 header,  用于 读取 token DPoP 和 客户端证书
+func grpcRequest(ctx context.Context, fullMethod string) *http.Request {
+	request := &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: fullMethod},
+		Header: http.Header{},
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for key, values := range md {
+			if strings.HasPrefix(key, ":") {
+				continue
+			}
+			for _, value := range values {
+				request.Header.Add(key, value)
+			}
+		}
+		if authority := md.Get(":authority"); len(authority) != 0 {
+			request.Host = authority[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			request.TLS = &info.State
+		}
+	}
+	return request
+}
+
+// errs.Error 的 StatusCode 转换成 gRPC code
+func GRPCCode(statusCode int) codes.Code {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	if statusCode >= http.StatusInternalServerError {
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+func GRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*errs.Error); ok {
+		message := e.Message
+		if message == "" && e.Err != nil {
+			message = e.Err.Error()
+		}
+		return status.Error(GRPCCode(e.StatusCode), message)
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,156 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *testServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+func grpcContext(val string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+val))
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/auth.Users/Get"}
+
+	if resp, err := UnaryServerInterceptor(GRPCConfig{})(context.Background(), nil, info, handler); err != nil || resp != "ok" {
+		t.Fatal("optional", resp, err)
+	}
+
+	_, err := UnaryServerInterceptor(GRPCConfig{TokenConfig: TokenConfig{Required: true}})(context.Background(), nil, info, handler)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatal("required", err)
+	}
+
+	_, err = UnaryServerInterceptor(GRPCConfig{Resource: MethodResource(bson.NewObjectId())})(context.Background(), nil, info, handler)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatal("scope", err)
+	}
+
+	resource := MethodResource("")(context.Background(), info.FullMethod)
+	if resource.Type != "auth.Users" || resource.Action != "Get" {
+		t.Fatal("MethodResource", resource)
+	}
+
+	if status.Code(GRPCError(ErrTokenRevoked)) != codes.Unauthenticated || GRPCCode(403) != codes.PermissionDenied || GRPCCode(503) != codes.Unavailable {
+		t.Fatal("GRPCCode")
+	}
+}
+
+func TestUnaryServerInterceptorToken(t *testing.T) {
+	signer := newTestSigner(t, "key")
+	auth, store, token := newTestAuth(t, signer, Options{})
+	application := bson.NewObjectId()
+	scopeToken := &Token{
+		ID:     bson.NewObjectId(),
+		Type:   "access",
+		UserID: token.UserID,
+		UserScopes: []*UserScope{
+			{Scope: &Scope{ApplicationID: application, Roles: []ScopeRole{{Status: "approved", User: "*", Type: "auth.Users", Action: "Get"}}}},
+		},
+		ExpiredAt: token.ExpiredAt,
+	}
+	if err := store.InsertToken(context.Background(), scopeToken); err != nil {
+		t.Fatal(err)
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/auth.Users/Get"}
+	c := GRPCConfig{TokenConfig: TokenConfig{Cache: true, Required: true}}
+	var found *Token
+	var user *User
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		found, _ = TokenFromContext(ctx)
+		user, _ = UserFromContext(ctx)
+		return "ok", nil
+	}
+
+	// token 和 用户 在 context
+	if _, err := auth.UnaryServerInterceptor(c)(grpcContext(signer.token(t, token, "")), nil, info, handler); err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.ID != token.ID || user == nil || user.ID != token.UserID {
+		t.Fatal("context", found, user)
+	}
+
+	// scope
+	c.Resource = MethodResource(application)
+	if _, err := auth.UnaryServerInterceptor(c)(grpcContext(signer.token(t, token, "")), nil, info, handler); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("scope deny", err)
+	}
+	if _, err := auth.UnaryServerInterceptor(c)(grpcContext(signer.token(t, scopeToken, "")), nil, info, handler); err != nil {
+		t.Fatal("scope allow", err)
+	}
+}
+
+func TestUnaryServerInterceptorUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{"errors":[{"message":"Bad gateway"}],"status_code":502}`))
+	}))
+	defer server.Close()
+	signer := newTestSigner(t, "key")
+	info := &grpc.UnaryServerInfo{FullMethod: "/auth.Users/Get"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	val := signer.token(t, &Token{ID: bson.NewObjectId(), Type: "access", UserID: bson.NewObjectId()}, "")
+
+	// 公钥 没有 加载
+	auth := NewAuth(Options{})
+	if _, err := auth.UnaryServerInterceptor(GRPCConfig{})(grpcContext(val), nil, info, handler); status.Code(err) != codes.Unavailable {
+		t.Fatal("keys", err)
+	}
+
+	// 上游 错误
+	auth, _, _ = newTestAuth(t, signer, Options{UserOrigin: server.URL, Retry: RetryConfig{Attempts: 1}})
+	if _, err := auth.UnaryServerInterceptor(GRPCConfig{})(grpcContext(val), nil, info, handler); status.Code(err) != codes.Unavailable {
+		t.Fatal("upstream", err)
+	}
+
+	// 没有 配置 UserOrigin
+	auth, _, _ = newTestAuth(t, signer, Options{})
+	if _, err := auth.UnaryServerInterceptor(GRPCConfig{})(grpcContext(val), nil, info, handler); status.Code(err) != codes.Internal {
+		t.Fatal("internal", err)
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	signer := newTestSigner(t, "key")
+	auth, _, token := newTestAuth(t, signer, Options{})
+	info := &grpc.StreamServerInfo{FullMethod: "/auth.Users/Watch"}
+	var found *Token
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		found, _ = TokenFromContext(stream.Context())
+		return nil
+	}
+	stream := &testServerStream{ctx: grpcContext(signer.token(t, token, ""))}
+	if err := auth.StreamServerInterceptor(GRPCConfig{TokenConfig: TokenConfig{Cache: true}})(nil, stream, info, handler); err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.ID != token.ID {
+		t.Fatal("stream context", found)
+	}
+
+	stream = &testServerStream{ctx: context.Background()}
+	if err := auth.StreamServerInterceptor(GRPCConfig{TokenConfig: TokenConfig{Required: true}})(nil, stream, info, handler); status.Code(err) != codes.Unauthenticated {
+		t.Fatal("stream required", err)
+	}
+}
@@ -0,0 +1,85 @@
+package model
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/otamoe/gin-server/errs"
+)
+
+// net/http 中间件,  token 用 TokenFromContext 读取
+func TokenHTTPMiddleware(c TokenConfig) func(http.Handler) http.Handler {
+	return defaultAuth.TokenHTTPMiddleware(c)
+}
+
+func (auth *Auth) TokenHTTPMiddleware(c TokenConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.setVary(w.Header())
+			token, err := auth.VerifyRequest(r.Context(), c, r, w.Header())
+			if err == nil && c.Required && token == nil {
+				err = ErrTokenNotFound
+			}
+			auth.metrics.tokenResult(token, err)
+			if err != nil {
+				if c.DPoP {
+					auth.Options().DPoP.withDefaults().challenge(w.Header())
+				}
+				writeHTTPError(w, unauthorizedError(err))
+				return
+			}
+			if token != nil {
+				r = r.WithContext(NewContextWithToken(r.Context(), token))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// net/http 中间件,  user 用 UserFromContext 读取.  param 读取 用户 id,  默认 r.PathValue("user")
+func UserHTTPMiddleware(c UserConfig, param func(r *http.Request) string) func(http.Handler) http.Handler {
+	return defaultAuth.UserHTTPMiddleware(c, param)
+}
+
+func (auth *Auth) UserHTTPMiddleware(c UserConfig, param func(r *http.Request) string) func(http.Handler) http.Handler {
+	if param == nil {
+		param = func(r *http.Request) string {
+			return r.PathValue("user")
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if userParam := param(r); userParam != "" {
+				user, err := auth.LookupUser(r.Context(), c, userParam)
+				if err != nil {
+					writeHTTPError(w, err)
+					return
+				}
+				r = r.WithContext(NewContextWithUser(r.Context(), user))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// 和 gin-server errs 一样的 格式
+func writeHTTPError(w http.ResponseWriter, err error) {
+	e, ok := err.(*errs.Error)
+	if !ok {
+		e = &errs.Error{
+			Err:        err,
+			Message:    http.StatusText(http.StatusInternalServerError),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	statusCode := e.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(&errs.Errors{
+		Errors:     []*errs.Error{e},
+		StatusCode: statusCode,
+	})
+}
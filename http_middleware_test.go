@@ -0,0 +1,49 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestHTTPMiddleware(t *testing.T) {
+	tokens, users := TokenStorage, UserStorage
+	defer ConfigStore(tokens, users)
+	store := NewMemoryStore()
+	ConfigStore(store, store)
+
+	user, err := store.UpsertUser(context.Background(), &User{ID: bson.NewObjectId(), Username: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found *User
+	mux := http.NewServeMux()
+	mux.Handle("/users/{user}", TokenHTTPMiddleware(TokenConfig{})(UserHTTPMiddleware(UserConfig{Cache: true}, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		found, _ = UserFromContext(r.Context())
+	}))))
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/users/"+user.ID.Hex(), nil))
+	if recorder.Code != http.StatusOK || found == nil || found.Username != "a" {
+		t.Fatal("user", recorder.Code, found)
+	}
+	if recorder.Header().Get("Vary") != "Authorization" {
+		t.Fatal("Vary", recorder.Header())
+	}
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/users/"+bson.NewObjectId().Hex(), nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatal("not found", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	TokenHTTPMiddleware(TokenConfig{Required: true})(http.NotFoundHandler()).ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatal("required", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,255 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/otamoe/gin-server/errs"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	VerifierJWT           = "jwt"
+	VerifierIntrospection = "introspection"
+	// 三段式 当作 JWT, 其他 内省
+	VerifierAuto = "auto"
+)
+
+type (
+	// RFC 7662
+	IntrospectionResponse struct {
+		Active   bool   `json:"active"`
+		Scope    string `json:"scope,omitempty"`
+		ClientID string `json:"client_id,omitempty"`
+		Username string `json:"username,omitempty"`
+		// RFC 7662 的 token_type 是 Bearer 这种,  Token.Type 使用 和 JWT 一样的 type
+		TokenType string       `json:"token_type,omitempty"`
+		Type      string       `json:"type,omitempty"`
+		ExpiresAt int64        `json:"exp,omitempty"`
+		IssuedAt  int64        `json:"iat,omitempty"`
+		NotBefore int64        `json:"nbf,omitempty"`
+		Subject   string       `json:"sub,omitempty"`
+		Audience  ClaimStrings `json:"aud,omitempty"`
+		Issuer    string       `json:"iss,omitempty"`
+		ID        string       `json:"jti,omitempty"`
+
+		Confirmation *TokenConfirmation `json:"cnf,omitempty"`
+	}
+
+	introspectionCacheValue struct {
+		token  *Token
+		claims *TokenClaims
+	}
+)
+
+var ErrTokenInactive error = &errs.Error{
+	Message:    "Token is not active",
+	Path:       "access_token",
+	Type:       "inactive",
+	StatusCode: http.StatusUnauthorized,
+}
+
+func (c TokenConfig) verifier(val string) string {
+	switch c.Verifier {
+	case "":
+		return VerifierJWT
+	case VerifierAuto:
+		if strings.Count(val, ".") == 2 {
+			return VerifierJWT
+		}
+		return VerifierIntrospection
+	}
+	return c.Verifier
+}
+
+func (auth *Auth) getIntrospectionToken(ctx context.Context, c TokenConfig, current *Token, val string) (token *Token, claims *TokenClaims, err error) {
+	var introspected *Token
+	if introspected, claims, err = auth.introspectToken(ctx, val); err != nil {
+		if err == ErrTokenInactive {
+			auth.negativeCacheSet(val, err)
+		}
+		return
+	}
+	if err = claims.Validate(c, time.Now()); err != nil {
+		return
+	}
+
+	if current != nil {
+		if current.ID != introspected.ID || current.UserID != introspected.UserID {
+			err = ErrTokenNotFound
+			return
+		}
+		token = current
+		return
+	}
+
+	token = introspected
+	if c.Cache && token.UserID.Valid() {
+		var user *User
+		found := true
+		if cached, ok := auth.cacheGetUser(token.UserID.Hex()); ok {
+			token.User = cached
+		} else if user, err = auth.findUser(ctx, token.UserID); err != nil {
+			if err != ErrNotFound {
+				return
+			}
+			err = nil
+			found = false
+		} else {
+			auth.cacheSetUser(user)
+			token.User = user
+		}
+		if found {
+			if err = auth.refreshTokenUser(ctx, c, token); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (auth *Auth) introspectToken(ctx context.Context, val string) (token *Token, claims *TokenClaims, err error) {
+	key := negativeCacheKey(val)
+	cache := auth.getIntrospectionCache()
+	if value, ok := cache.Get(key); ok {
+		token, claims = value.(*introspectionCacheValue).copy()
+		return
+	}
+
+	var response *IntrospectionResponse
+	if response, err = auth.requestIntrospection(ctx, val); err != nil {
+		return
+	}
+	if !response.Active {
+		err = ErrTokenInactive
+		return
+	}
+
+	// 不超过 exp
+	cacheValue := response.cacheValue()
+	cache.Set(key, cacheValue, cacheValue.token.ExpiredAt)
+	token, claims = cacheValue.copy()
+	return
+}
+
+func (response *IntrospectionResponse) cacheValue() (value *introspectionCacheValue) {
+	token := &Token{
+		Type:    response.Type,
+		Scope:   response.Scope,
+		Subject: response.Subject,
+		Client:  response.ClientID,
+	}
+	if bson.IsObjectIdHex(response.ID) {
+		token.ID = bson.ObjectIdHex(response.ID)
+	}
+	if bson.IsObjectIdHex(response.Subject) {
+		token.UserID = bson.ObjectIdHex(response.Subject)
+		token.User = &User{
+			ID:       token.UserID,
+			Username: response.Username,
+		}
+	}
+	if bson.IsObjectIdHex(response.ClientID) {
+		token.ClientID = bson.ObjectIdHex(response.ClientID)
+	}
+	if response.IssuedAt != 0 {
+		createdAt := time.Unix(response.IssuedAt, 0)
+		token.CreatedAt = &createdAt
+	}
+	if response.ExpiresAt != 0 {
+		expiredAt := time.Unix(response.ExpiresAt, 0)
+		token.ExpiredAt = &expiredAt
+	}
+
+	claims := &TokenClaims{
+		UserID:   token.UserID,
+		Type:     response.Type,
+		Scope:    response.Scope,
+		Username: response.Username,
+		Audience: response.Audience,
+
+		Confirmation: response.Confirmation,
+	}
+	claims.Id = response.ID
+	claims.Subject = response.Subject
+	claims.Issuer = response.Issuer
+	claims.ExpiresAt = response.ExpiresAt
+	claims.IssuedAt = response.IssuedAt
+	claims.NotBefore = response.NotBefore
+
+	value = &introspectionCacheValue{
+		token:  token,
+		claims: claims,
+	}
+	return
+}
+
+func (value *introspectionCacheValue) copy() (token *Token, claims *TokenClaims) {
+	tokenValue := *value.token
+	token = &tokenValue
+	if token.User != nil {
+		user := *token.User
+		token.User = &user
+	}
+	claimsValue := *value.claims
+	claims = &claimsValue
+	return
+}
+
+func (auth *Auth) introspectionURL() string {
+	options := auth.Options()
+	if options.IntrospectionURL != "" {
+		return options.IntrospectionURL
+	}
+	if options.AuthOrigin != "" {
+		return options.AuthOrigin + "/introspect"
+	}
+	return ""
+}
+
+func (auth *Auth) requestIntrospection(ctx context.Context, val string) (value *IntrospectionResponse, err error) {
+	options := auth.Options()
+	introspectionURL := auth.introspectionURL()
+	if introspectionURL == "" {
+		err = errors.New("auth-model.AuthOrigin variable not configured")
+		return
+	}
+	var request *http.Request
+	form := url.Values{}
+	form.Set("token", val)
+	form.Set("token_type_hint", "access_token")
+	if request, err = http.NewRequest("POST", introspectionURL, strings.NewReader(form.Encode())); err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(options.ClientID), url.QueryEscape(options.ClientSecret))
+
+	var statusCode int
+	var bodyBytes []byte
+	if statusCode, bodyBytes, err = auth.doUpstream(ctx, upstreamIntrospection, request, 1<<20); err != nil {
+		return
+	}
+
+	logrus.Debugf("[INTROSPECTION] %d %s", statusCode, string(bodyBytes))
+
+	if statusCode >= http.StatusMultipleChoices {
+		err = &errs.Error{
+			Message:    "Token introspection error",
+			StatusCode: http.StatusBadGateway,
+			Params:     map[string]interface{}{"status_code": statusCode},
+		}
+		return
+	}
+	value = &IntrospectionResponse{}
+	if err = json.Unmarshal(bodyBytes, value); err != nil {
+		return
+	}
+	return
+}
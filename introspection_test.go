@@ -0,0 +1,128 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	ginResource "github.com/otamoe/gin-server/resource"
+)
+
+func TestIntrospection(t *testing.T) {
+	tokenID, userID, tokenClientID := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	exp := time.Now().Add(time.Minute).Unix()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		clientID, clientSecret, _ := r.BasicAuth()
+		if r.Method != "POST" || clientID != "client" || clientSecret != "secret" || r.PostFormValue("token_type_hint") != "access_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		response := &IntrospectionResponse{}
+		switch r.PostFormValue("token") {
+		case "active":
+			response = &IntrospectionResponse{
+				Active:    true,
+				TokenType: "Bearer",
+				Type:      "access",
+				Scope:     "post:get comment:*",
+				Username:  "a",
+				Subject:   userID.Hex(),
+				ID:        tokenID.Hex(),
+				ClientID:  tokenClientID.Hex(),
+				ExpiresAt: exp,
+			}
+		case "opaque":
+			response = &IntrospectionResponse{Active: true, Type: "access", Scope: "post:get", Subject: "user@example.com", ClientID: "client-a", ExpiresAt: exp}
+		case "expired":
+			response = &IntrospectionResponse{Active: true, Type: "access", ExpiresAt: time.Now().Add(-time.Second).Unix()}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	auth := NewAuth(Options{IntrospectionURL: server.URL, ClientID: "client", ClientSecret: "secret"})
+	ctx := context.Background()
+	c := TokenConfig{Verifier: VerifierIntrospection, Types: []string{"access"}}
+
+	token, err := auth.VerifyToken(ctx, c, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.ID != tokenID || token.UserID != userID || token.ClientID != tokenClientID || token.Type != "access" || token.User == nil || token.User.Username != "a" {
+		t.Fatal("token", token)
+	}
+	// scope 检查
+	if token.Scope != "post:get comment:*" {
+		t.Fatal("scope", token.Scope)
+	}
+	application := bson.NewObjectId()
+	for _, resource := range []*ginResource.Resource{
+		{Application: application, Type: "post", Action: "get"},
+		{Application: application, Type: "post", Action: "get", Owner: userID},
+		{Application: application, Type: "comment", Action: "delete", Owner: userID},
+	} {
+		if _, err = token.ValidateScope(resource); err != nil {
+			t.Fatal("ValidateScope", resource, err)
+		}
+	}
+	for _, resource := range []*ginResource.Resource{
+		{Application: application, Type: "post", Action: "delete"},
+		{Application: application, Type: "post", Action: "get", Owner: bson.NewObjectId()},
+	} {
+		if _, err = token.ValidateScope(resource); err == nil {
+			t.Fatal("ValidateScope deny", resource)
+		}
+	}
+	if _, err = auth.VerifyToken(ctx, c, "active"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatal("cached requests", n)
+	}
+	// 缓存 不超过 exp
+	element := auth.getIntrospectionCache().items[negativeCacheKey("active")]
+	if expiredAt := element.Value.(*lruEntry).expiredAt; !expiredAt.Equal(time.Unix(exp, 0)) {
+		t.Fatal("cache expiredAt", expiredAt)
+	}
+	if _, err = auth.VerifyToken(ctx, TokenConfig{Verifier: VerifierIntrospection, Types: []string{"refresh"}}, "active"); err != ErrTokenNotFound {
+		t.Fatal("Types", err)
+	}
+
+	// sub client_id 不是 ObjectId
+	if token, err = auth.VerifyToken(ctx, c, "opaque"); err != nil {
+		t.Fatal(err)
+	}
+	if token.Subject != "user@example.com" || token.Client != "client-a" || token.UserID.Valid() || token.Scope != "post:get" {
+		t.Fatal("opaque", token)
+	}
+	if _, err = token.ValidateScope(&ginResource.Resource{Type: "post", Action: "get"}); err != nil {
+		t.Fatal("opaque ValidateScope", err)
+	}
+
+	// 已经 过期 的 不缓存
+	for i := 0; i < 2; i++ {
+		if _, _, err = auth.introspectToken(ctx, "expired"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 4 {
+		t.Fatal("expired requests", n)
+	}
+
+	// 不活跃 的 进入 negative 缓存
+	for i := 0; i < 2; i++ {
+		if _, err = auth.VerifyToken(ctx, c, "inactive"); err != ErrTokenInactive {
+			t.Fatal("inactive", err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 5 {
+		t.Fatal("inactive requests", n)
+	}
+}
@@ -0,0 +1,139 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+type (
+	issuerSet struct {
+		sync.RWMutex
+		values map[string]*Auth
+	}
+
+	// 解析 JWT 时 先 用 MapClaims 修改 原始 claims,  再 解析到 TokenClaims
+	mappedTokenClaims struct {
+		*TokenClaims
+		mapClaims func(claims map[string]interface{}) error
+	}
+)
+
+var (
+	ErrIssuerRequired   = errors.New("issuer required")
+	ErrIssuerRegistered = errors.New("issuer already registered")
+)
+
+// 注册 其他 issuer,  token 的 iss 等于 options.Issuer 时 用 返回的 Auth 验证 和 请求 token 用户
+// 保存的 token 记录 issuer,  和 主 Auth 共用 TokenStore 时 不能 用 其他 issuer 的 token.  已经 Start 时 马上 启动
+func RegisterIssuer(options Options) (*Auth, error) {
+	return defaultAuth.RegisterIssuer(options)
+}
+
+func (auth *Auth) RegisterIssuer(options Options) (issuer *Auth, err error) {
+	if options.Issuer == "" {
+		err = ErrIssuerRequired
+		return
+	}
+	auth.running.Lock()
+	defer auth.running.Unlock()
+
+	auth.issuers.Lock()
+	if _, ok := auth.issuers.values[options.Issuer]; ok {
+		auth.issuers.Unlock()
+		err = ErrIssuerRegistered
+		return
+	}
+	issuer = NewAuth(options)
+	issuer.metrics = auth.metrics
+	if auth.issuers.values == nil {
+		auth.issuers.values = map[string]*Auth{}
+	}
+	auth.issuers.values[options.Issuer] = issuer
+	auth.issuers.Unlock()
+
+	if handle := auth.running.handle; handle != nil {
+		issuer.start(handle)
+	}
+	return
+}
+
+func (auth *Auth) getIssuers() (issuers []*Auth) {
+	auth.issuers.RLock()
+	defer auth.issuers.RUnlock()
+	for _, issuer := range auth.issuers.values {
+		issuers = append(issuers, issuer)
+	}
+	return
+}
+
+// 没有 注册 的 iss 使用 auth 自己
+func (auth *Auth) issuer(iss string) *Auth {
+	if iss == "" {
+		return auth
+	}
+	auth.issuers.RLock()
+	defer auth.issuers.RUnlock()
+	if issuer, ok := auth.issuers.values[iss]; ok {
+		return issuer
+	}
+	return auth
+}
+
+// 按 未验证的 iss 选择 issuer,  签名 由 选中 issuer 的 公钥 验证
+func (auth *Auth) tokenIssuer(val string) *Auth {
+	auth.issuers.RLock()
+	empty := len(auth.issuers.values) == 0
+	auth.issuers.RUnlock()
+	if empty {
+		return auth
+	}
+	claims := &jwt.StandardClaims{}
+	if _, _, err := (&jwt.Parser{}).ParseUnverified(val, claims); err != nil {
+		return auth
+	}
+	return auth.issuer(claims.Issuer)
+}
+
+func (auth *Auth) newTokenClaims() (claims *TokenClaims, jwtClaims jwt.Claims) {
+	claims = &TokenClaims{}
+	jwtClaims = claims
+	if mapClaims := auth.Options().MapClaims; mapClaims != nil {
+		jwtClaims = &mappedTokenClaims{TokenClaims: claims, mapClaims: mapClaims}
+	}
+	return
+}
+
+func (claims *mappedTokenClaims) UnmarshalJSON(data []byte) (err error) {
+	values := map[string]interface{}{}
+	if err = json.Unmarshal(data, &values); err != nil {
+		return
+	}
+	if err = claims.mapClaims(values); err != nil {
+		return
+	}
+	if data, err = json.Marshal(values); err != nil {
+		return
+	}
+	err = json.Unmarshal(data, claims.TokenClaims)
+	return
+}
+
+// 重命名 claim,  names 是 issuer 的 claim 名称 到 TokenClaims 的 json 名称,  例如 {"uid": "user_id"}
+func RenameClaims(names map[string]string) func(claims map[string]interface{}) error {
+	return func(claims map[string]interface{}) error {
+		renamed := map[string]interface{}{}
+		for from, to := range names {
+			if value, ok := claims[from]; ok {
+				delete(claims, from)
+				renamed[to] = value
+			}
+		}
+		for key, value := range renamed {
+			claims[key] = value
+		}
+		return nil
+	}
+}
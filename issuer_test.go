@@ -0,0 +1,124 @@
+package model
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestRegisterIssuer(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := json.Marshal(map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kty": "OKP",
+					"kid": "partner",
+					"crv": "Ed25519",
+					"x":   base64.RawURLEncoding.EncodeToString(publicKey),
+				},
+			},
+		})
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	auth := NewAuth(Options{})
+	handle := auth.Start()
+	defer handle.Stop()
+	options := Options{
+		Issuer:    "https://partner.example",
+		KeysURL:   server.URL,
+		MapClaims: RenameClaims(map[string]string{"uid": "user_id"}),
+	}
+	issuer, err := auth.RegisterIssuer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Start 之后 注册 的 也 获取 公钥
+	if issuer.loadTokenPublicKeys() == nil {
+		t.Fatal("keys")
+	}
+	if _, err = auth.RegisterIssuer(options); err != ErrIssuerRegistered {
+		t.Fatal("duplicate", err)
+	}
+	if _, err = auth.RegisterIssuer(Options{}); err != ErrIssuerRequired {
+		t.Fatal("required", err)
+	}
+
+	userID := bson.NewObjectId()
+	jwtToken := jwt.NewWithClaims(SigningMethodEd25519, jwt.MapClaims{
+		"name": "token",
+		"iss":  "https://partner.example",
+		"uid":  userID.Hex(),
+	})
+	jwtToken.Header["kid"] = "partner"
+	val, err := jwtToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth.tokenIssuer(val) != issuer {
+		t.Fatal("tokenIssuer")
+	}
+	_, claims, err := issuer.parseTokenClaims(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != userID || claims.Issuer != "https://partner.example" {
+		t.Fatal("MapClaims", claims)
+	}
+
+	jwtToken.Claims = jwt.MapClaims{"name": "token", "iss": "other"}
+	if val, err = jwtToken.SignedString(privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if auth.tokenIssuer(val) != auth {
+		t.Fatal("tokenIssuer other")
+	}
+}
+
+// 共用 TokenStore 时 其他 issuer 签名 的 JWT 不能 使用 主 Auth 的 token
+func TestRegisterIssuerTokenStore(t *testing.T) {
+	signer, partner := newTestSigner(t, "key"), newTestSigner(t, "partner")
+	auth, store, token := newTestAuth(t, signer, Options{})
+	issuer, err := auth.RegisterIssuer(Options{Issuer: "https://partner.example", TokenStore: store, UserStore: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.keys.publicKeys.Store(partner.publicKeys)
+	ctx := context.Background()
+	c := TokenConfig{Cache: true}
+
+	if _, err = auth.VerifyToken(ctx, c, partner.token(t, token, "https://partner.example")); err != ErrTokenNotFound {
+		t.Fatal("partner", err)
+	}
+	if _, err = auth.VerifyToken(ctx, c, signer.token(t, token, "")); err != nil {
+		t.Fatal(err)
+	}
+
+	// issuer 保存的 token 主 Auth 也 不能 使用
+	expiredAt := time.Now().Add(time.Hour)
+	partnerToken := &Token{ID: bson.NewObjectId(), Type: "access", UserID: token.UserID, ExpiredAt: &expiredAt, Issuer: "https://partner.example"}
+	if err = store.InsertToken(ctx, partnerToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = auth.VerifyToken(ctx, c, signer.token(t, partnerToken, "")); err != ErrTokenNotFound {
+		t.Fatal("primary", err)
+	}
+	if _, err = auth.VerifyToken(ctx, c, partner.token(t, partnerToken, "https://partner.example")); err != nil {
+		t.Fatal(err)
+	}
+}
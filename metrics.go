@@ -0,0 +1,184 @@
+package model
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/otamoe/gin-server/errs"
+	ginResource "github.com/otamoe/gin-server/resource"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// 注册的 issuer 共用 一个
+	authMetrics struct {
+		tokenResults     *prometheus.CounterVec
+		scopeDecisions   *prometheus.CounterVec
+		storeLookups     *prometheus.CounterVec
+		upstreamDuration *prometheus.HistogramVec
+	}
+
+	// prometheus.Collector,  缓存 和 公钥 在 Collect 时 读取
+	collector struct {
+		auth *Auth
+
+		cacheHits       *prometheus.Desc
+		cacheMisses     *prometheus.Desc
+		cacheEntries    *prometheus.Desc
+		keysAge         *prometheus.Desc
+		keysRefreshes   *prometheus.Desc
+		keysFailures    *prometheus.Desc
+		keysRateLimited *prometheus.Desc
+		keysUnknown     *prometheus.Desc
+		auditDropped    *prometheus.Desc
+	}
+)
+
+func newAuthMetrics(name string) *authMetrics {
+	labels := prometheus.Labels{"name": name}
+	return &authMetrics{
+		tokenResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "auth",
+			ConstLabels: labels,
+			Name:        "token_verifications_total",
+			Help:        "Token middleware results, ok, none or the error type.",
+		}, []string{"result"}),
+		scopeDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "auth",
+			ConstLabels: labels,
+			Name:        "scope_decisions_total",
+			Help:        "Token.ValidateScope decisions.",
+		}, []string{"application", "action", "decision"}),
+		storeLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "auth",
+			ConstLabels: labels,
+			Name:        "store_lookups_total",
+			Help:        "Tokens and users found in the store (hit) or requested from upstream (fetch).",
+		}, []string{"model", "result"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   "auth",
+			ConstLabels: labels,
+			Name:        "upstream_request_duration_seconds",
+			Help:        "Upstream request latency including retries.",
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"endpoint", "code"}),
+	}
+}
+
+func (metrics *authMetrics) tokenResult(token *Token, err error) {
+	result := "ok"
+	if err != nil {
+		result = errorType(err)
+	} else if token == nil {
+		result = "none"
+	}
+	metrics.tokenResults.WithLabelValues(result).Inc()
+}
+
+func (metrics *authMetrics) scopeDecision(resource *ginResource.Resource, err error) {
+	metrics.scopeDecisions.WithLabelValues(resource.Application.Hex(), resource.Action, scopeDecision(err)).Inc()
+}
+
+// model 是 ModelToken ModelUser 的 Name,  result 是 hit 或 fetch
+func (metrics *authMetrics) storeLookup(model string, result string) {
+	metrics.storeLookups.WithLabelValues(model, result).Inc()
+}
+
+func scopeDecision(err error) string {
+	if err != nil {
+		return "deny"
+	}
+	return "allow"
+}
+
+func (metrics *authMetrics) upstream(endpoint string, statusCode int, err error, start time.Time) {
+	code := strconv.Itoa(statusCode)
+	if err == ErrUpstreamUnavailable {
+		code = "unavailable"
+	} else if err != nil {
+		code = "error"
+	}
+	metrics.upstreamDuration.WithLabelValues(endpoint, code).Observe(time.Since(start).Seconds())
+}
+
+func errorType(err error) string {
+	if e, ok := err.(*errs.Error); ok && e.Type != "" {
+		return e.Type
+	}
+	return "error"
+}
+
+// 默认实例 的 Collector,  prometheus.MustRegister(model.Collector())
+func Collector() prometheus.Collector {
+	return defaultAuth.Collector()
+}
+
+// 包括 注册的 issuer,  用 issuer label 区分.  Options.Name 是 name label
+func (auth *Auth) Collector() prometheus.Collector {
+	issuer := []string{"issuer"}
+	labels := prometheus.Labels{"name": auth.Options().Name}
+	return &collector{
+		auth:            auth,
+		cacheHits:       prometheus.NewDesc("auth_cache_hits_total", "LRU cache hits.", []string{"issuer", "cache"}, labels),
+		cacheMisses:     prometheus.NewDesc("auth_cache_misses_total", "LRU cache misses.", []string{"issuer", "cache"}, labels),
+		cacheEntries:    prometheus.NewDesc("auth_cache_entries", "LRU cache entries.", []string{"issuer", "cache"}, labels),
+		keysAge:         prometheus.NewDesc("auth_keys_age_seconds", "Age of the loaded key set.", issuer, labels),
+		keysRefreshes:   prometheus.NewDesc("auth_keys_refreshes_total", "On-demand key set refreshes.", issuer, labels),
+		keysFailures:    prometheus.NewDesc("auth_keys_refresh_failures_total", "Failed key set requests.", issuer, labels),
+		keysRateLimited: prometheus.NewDesc("auth_keys_rate_limited_total", "On-demand key set refreshes skipped by KeysRefreshInterval.", issuer, labels),
+		keysUnknown:     prometheus.NewDesc("auth_keys_unknown_total", "Tokens signed with an unknown kid.", issuer, labels),
+		auditDropped:    prometheus.NewDesc("auth_audit_dropped_total", "Audit events dropped because the sink queue was full.", issuer, labels),
+	}
+}
+
+func (collector *collector) Describe(ch chan<- *prometheus.Desc) {
+	metrics := collector.auth.metrics
+	metrics.tokenResults.Describe(ch)
+	metrics.scopeDecisions.Describe(ch)
+	metrics.storeLookups.Describe(ch)
+	metrics.upstreamDuration.Describe(ch)
+	ch <- collector.cacheHits
+	ch <- collector.cacheMisses
+	ch <- collector.cacheEntries
+	ch <- collector.keysAge
+	ch <- collector.keysRefreshes
+	ch <- collector.keysFailures
+	ch <- collector.keysRateLimited
+	ch <- collector.keysUnknown
+	ch <- collector.auditDropped
+}
+
+func (collector *collector) Collect(ch chan<- prometheus.Metric) {
+	metrics := collector.auth.metrics
+	metrics.tokenResults.Collect(ch)
+	metrics.scopeDecisions.Collect(ch)
+	metrics.storeLookups.Collect(ch)
+	metrics.upstreamDuration.Collect(ch)
+
+	for _, auth := range append([]*Auth{collector.auth}, collector.auth.getIssuers()...) {
+		issuer := auth.Options().Issuer
+		for name, cache := range map[string]*lruCache{
+			"token":      auth.getTokenCache(),
+			"user":       auth.getUserCache(),
+			"revocation": auth.getRevocationCache(),
+			"negative":   auth.getNegativeCache(),
+		} {
+			stats := cache.Stats()
+			ch <- prometheus.MustNewConstMetric(collector.cacheHits, prometheus.CounterValue, float64(stats.Hits), issuer, name)
+			ch <- prometheus.MustNewConstMetric(collector.cacheMisses, prometheus.CounterValue, float64(stats.Misses), issuer, name)
+			ch <- prometheus.MustNewConstMetric(collector.cacheEntries, prometheus.GaugeValue, float64(stats.Len), issuer, name)
+		}
+
+		if publicKeys := auth.loadTokenPublicKeys(); publicKeys != nil {
+			ch <- prometheus.MustNewConstMetric(collector.keysAge, prometheus.GaugeValue, time.Since(publicKeys.Time).Seconds(), issuer)
+		}
+		stats := auth.GetTokenKeysStats()
+		ch <- prometheus.MustNewConstMetric(collector.keysRefreshes, prometheus.CounterValue, float64(stats.Refreshes), issuer)
+		ch <- prometheus.MustNewConstMetric(collector.keysFailures, prometheus.CounterValue, float64(stats.Failures), issuer)
+		ch <- prometheus.MustNewConstMetric(collector.keysRateLimited, prometheus.CounterValue, float64(stats.RateLimited), issuer)
+		ch <- prometheus.MustNewConstMetric(collector.keysUnknown, prometheus.CounterValue, float64(stats.Unknown), issuer)
+		if sink, ok := auth.Options().AuditLog.(auditDropper); ok {
+			ch <- prometheus.MustNewConstMetric(collector.auditDropped, prometheus.CounterValue, float64(sink.Dropped()), issuer)
+		}
+	}
+}
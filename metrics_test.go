@@ -0,0 +1,107 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	ginResource "github.com/otamoe/gin-server/resource"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	auth := NewAuth(Options{Name: "a"})
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(auth.Collector()); err != nil {
+		t.Fatal(err)
+	}
+	// 多个 实例 用 name label 区分
+	if err := registry.Register(NewAuth(Options{Name: "b"}).Collector()); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	auth.TokenHTTPMiddleware(TokenConfig{Required: true})(http.NotFoundHandler()).ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	token := &Token{auth: auth}
+	application := bson.NewObjectId()
+	token.ValidateScope(&ginResource.Resource{Application: application, Action: "get"})
+
+	values := gatherCounters(t, registry)
+	if values["auth_token_verifications_total a not_found"] != 1 {
+		t.Fatal("token_verifications_total", values)
+	}
+	if _, ok := values["auth_cache_hits_total token  b"]; !ok {
+		t.Fatal("cache_hits_total", values)
+	}
+	// label 按 名称 排序 action application decision name
+	if values["auth_scope_decisions_total get "+application.Hex()+" deny a"] != 1 {
+		t.Fatal("scope_decisions_total", values)
+	}
+}
+
+func TestCollectorStoreLookups(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[{"message":"Not found"}],"status_code":404}`))
+	}))
+	defer server.Close()
+	signer := newTestSigner(t, "key")
+	auth, store, token := newTestAuth(t, signer, Options{Name: "a", UserOrigin: server.URL})
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(auth.Collector()); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// store 里 有 的 token 和 用户
+	if _, err := auth.VerifyToken(ctx, TokenConfig{Cache: true}, signer.token(t, token, "")); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.UpsertUser(ctx, &User{ID: bson.NewObjectId(), Username: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = auth.LookupUser(ctx, UserConfig{Cache: true}, user.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 上游 请求
+	other := &Token{ID: bson.NewObjectId(), Type: "access", UserID: bson.NewObjectId()}
+	if _, err = auth.VerifyToken(ctx, TokenConfig{Cache: true}, signer.token(t, other, "")); err == nil {
+		t.Fatal("token not found")
+	}
+	if _, err = auth.LookupUser(ctx, UserConfig{Cache: true, Fetch: true}, bson.NewObjectId().Hex()); err == nil {
+		t.Fatal("user not found")
+	}
+
+	values := gatherCounters(t, registry)
+	// label 按 名称 排序 model name result
+	for _, key := range []string{"tokens a hit", "users a hit", "tokens a fetch", "users a fetch"} {
+		if values["auth_store_lookups_total "+key] != 1 {
+			t.Fatal("store_lookups_total", key, values)
+		}
+	}
+}
+
+// counter 的 值,  key 是 名称 和 label 值
+func gatherCounters(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := family.GetName()
+			for _, label := range metric.GetLabel() {
+				labels += " " + label.GetValue()
+			}
+			if metric.Counter != nil {
+				values[labels] = metric.Counter.GetValue()
+			}
+		}
+	}
+	return values
+}
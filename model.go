@@ -1,12 +1,123 @@
 package model
 
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	mgoModel "github.com/otamoe/mgo-model"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	Handle struct {
+		auth   *Auth
+		ctx    context.Context
+		cancel context.CancelFunc
+		wg     sync.WaitGroup
+	}
+
+	Status struct {
+		Ready       bool          `json:"ready"`
+		KeysCount   int           `json:"keys_count"`
+		KeysTime    *time.Time    `json:"keys_time,omitempty"`
+		KeysAge     time.Duration `json:"keys_age,omitempty"`
+		LastError   string        `json:"last_error,omitempty"`
+		LastErrorAt *time.Time    `json:"last_error_at,omitempty"`
+	}
+)
+
 var (
 	AuthOrigin   string
 	UserOrigin   string
 	ClientID     string
 	ClientSecret string
+
+	// 公钥地址 默认 AuthOrigin + "/keys", 可以是任意 JWKS (RFC 7517) 地址
+	KeysURL string
+
+	// 允许的 签名算法,  HS256 只用于本地开发
+	Algorithms = defaultAlgorithms()
+
+	// kid 未找到时 按需更新公钥的 最小间隔
+	KeysRefreshInterval = time.Second * 30
+
+	// 计划更新公钥的 间隔
+	KeysRefreshPeriod = time.Hour
+
+	// 更新公钥失败 重试间隔 指数增加
+	KeysRetryMin = time.Second
+	KeysRetryMax = time.Minute
+
+	// 令牌内省地址  RFC 7662, 默认 AuthOrigin + "/introspect"
+	IntrospectionURL       string
+	IntrospectionCacheTTL  = time.Minute * 5
+	IntrospectionCacheSize = 10000
+
+	// DPoP proof 允许的算法 和 有效期
+	DPoPAlgorithms      = defaultAlgorithms()
+	DPoPProofTTL        = time.Minute * 5
+	DPoPNonceTTL        = time.Minute * 5
+	DPoPReplayCacheSize = 100000
+
+	// 默认 Auth 的 进程内 LRU 缓存,  第一次使用前 设置,  和 CacheConfig 一样 0 使用 默认,  小于 0 不缓存.  NewAuth 使用 Options.Caches
+	TokenCacheSize = 10000
+	TokenCacheTTL  = time.Minute
+	UserCacheSize  = 10000
+	UserCacheTTL   = time.Minute
+
+	// 被拒绝的 token 缓存,  签名错误 上游 401 404 用户不存在
+	NegativeCacheSize = 10000
+	NegativeCacheTTL  = time.Second * 30
+
+	// token 过期 多久之后 从 tokens 集合 删除,  需要 ConfigTokenExpiry 开启 TTL 索引 或 Handle.SweepTokens.  0 是 1 小时,  小于 0 过期 立即 删除
+	TokenExpireGrace = time.Hour
+
+	// 撤销列表地址  设置后 Start 会定时同步
+	RevocationURL           string
+	RevocationRefreshPeriod = time.Minute
+
+	// 请求 上游 的 client,  nil 使用 http.DefaultClient.  自定义 TLS 根证书 代理 设置 Transport
+	HTTPClient *http.Client
+
+	// 每个 上游 请求的 超时
+	UpstreamTimeouts = Timeouts{
+		Token:         time.Second * 10,
+		User:          time.Second * 10,
+		Keys:          time.Second * 10,
+		Introspection: time.Second * 10,
+		Revocations:   time.Second * 10,
+	}
+
+	// GET 请求 网络错误 或 5xx 重试
+	UpstreamRetry = RetryConfig{
+		Attempts: 3,
+		Min:      time.Millisecond * 100,
+		Max:      time.Second * 2,
+	}
+
+	// 上游 连续失败 后 熔断,  期间 返回 ErrUpstreamUnavailable
+	UpstreamBreaker = BreakerConfig{
+		Failures: 5,
+		Open:     time.Second * 30,
+	}
+
+	// OpenTelemetry,  nil 使用 otel.GetTracerProvider() 和 W3C traceparent
+	TracerProvider trace.TracerProvider
+	Propagator     propagation.TextMapPropagator
+
+	// ValidateScope 的 审计日志,  nil 不记录.  NewMongoAuditSink NewMgoAuditSink 或 NewWriterAuditSink
+	AuditLog AuditSink
 )
 
+func defaultAlgorithms() []string {
+	return []string{"ES256", "ES384", "ES512", "RS256", "PS256", "EdDSA"}
+}
+
 func Config(authOrigin string, userOrigin string, clientID string, clientSecret string) {
 	AuthOrigin = authOrigin
 	UserOrigin = userOrigin
@@ -14,6 +125,126 @@ func Config(authOrigin string, userOrigin string, clientID string, clientSecret
 	ClientSecret = clientSecret
 }
 
-func Start() {
-	initTokenPublicKeys()
+func Start() (handle *Handle) {
+	return defaultAuth.Start()
+}
+
+// 第一次获取公钥失败 不会 panic,  后台会继续重试, 用 GetStatus 检查是否就绪.  已经 启动 时 返回 同一个 handle
+func (auth *Auth) Start() (handle *Handle) {
+	auth.running.Lock()
+	defer auth.running.Unlock()
+	if handle = auth.running.handle; handle != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	handle = &Handle{
+		auth:   auth,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	auth.running.handle = handle
+	// 注册的 issuer 也 定时 更新 公钥 和 撤销列表
+	for _, value := range append([]*Auth{auth}, auth.getIssuers()...) {
+		value.start(handle)
+	}
+	return
+}
+
+func (auth *Auth) start(handle *Handle) {
+	loaded := auth.loadTokenPublicKeysOnce(handle.ctx)
+	handle.Go(func(ctx context.Context) {
+		auth.runTokenPublicKeys(ctx, loaded)
+	})
+	if auth.Options().RevocationURL != "" {
+		handle.Go(auth.runRevocations)
+	}
+}
+
+// 后台任务,  Stop 时 ctx 会取消
+func (handle *Handle) Go(fn func(ctx context.Context)) {
+	handle.wg.Add(1)
+	go func() {
+		defer handle.wg.Done()
+		fn(handle.ctx)
+	}()
+}
+
+// 定时 删除 过期 token,  用于 不能使用 TTL 索引 的部署.  session 只有 MgoStore 需要,  其他存储 传 nil
+func (handle *Handle) SweepTokens(session *mgo.Session, period time.Duration) {
+	handle.Go(func(ctx context.Context) {
+		for sleepContext(ctx, period) {
+			var n int
+			var err error
+			if session == nil {
+				n, err = handle.auth.PurgeExpiredTokens(ctx)
+			} else {
+				s := session.Copy()
+				n, err = handle.auth.PurgeExpiredTokens(context.WithValue(ctx, mgoModel.CONTEXT, s))
+				s.Close()
+			}
+			if err != nil {
+				logrus.Error("[TOKEN_SWEEP]", err)
+			} else {
+				logrus.Debugf("[TOKEN_SWEEP] %d", n)
+			}
+		}
+	})
+}
+
+// 之后 可以 再次 Start
+func (handle *Handle) Stop() {
+	// 先 清除,  之后 RegisterIssuer 不会 再 添加 任务
+	auth := handle.auth
+	auth.running.Lock()
+	if auth.running.handle == handle {
+		auth.running.handle = nil
+	}
+	auth.running.Unlock()
+	handle.cancel()
+	handle.wg.Wait()
+	// 写完 异步 审计 队列
+	for _, value := range append([]*Auth{auth}, auth.getIssuers()...) {
+		if sink, ok := value.Options().AuditLog.(auditStopper); ok {
+			sink.Stop()
+		}
+	}
+}
+
+func (handle *Handle) Close() error {
+	handle.Stop()
+	return nil
+}
+
+func (handle *Handle) Status() Status {
+	return handle.auth.GetStatus()
+}
+
+func GetStatus() (status Status) {
+	return defaultAuth.GetStatus()
+}
+
+func (auth *Auth) GetStatus() (status Status) {
+	if publicKeys := auth.loadTokenPublicKeys(); publicKeys != nil {
+		keysTime := publicKeys.Time
+		status.Ready = true
+		status.KeysCount = len(publicKeys.Results)
+		status.KeysTime = &keysTime
+		status.KeysAge = time.Since(keysTime)
+	}
+	if err, errAt := auth.tokenKeysLastError(); err != nil {
+		status.LastError = err.Error()
+		status.LastErrorAt = &errAt
+	}
+	return
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
 }
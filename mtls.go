@@ -0,0 +1,96 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/otamoe/gin-server/errs"
+)
+
+// RFC 8705
+var (
+	ErrTokenCertificateRequired error = &errs.Error{
+		Message:    "Client certificate is required",
+		Path:       "access_token",
+		Type:       "certificate_required",
+		StatusCode: http.StatusUnauthorized,
+	}
+	ErrTokenCertificateMismatch error = &errs.Error{
+		Message:    "Token is not bound to the client certificate",
+		Path:       "access_token",
+		Type:       "certificate_mismatch",
+		StatusCode: http.StatusUnauthorized,
+	}
+)
+
+func checkCertificateBound(request *http.Request, c TokenConfig, claims *TokenClaims) (err error) {
+	var x5t string
+	if claims.Confirmation != nil {
+		x5t = claims.Confirmation.X5TS256
+	}
+	if x5t == "" {
+		err = ErrTokenCertificateMismatch
+		return
+	}
+	der := clientCertificate(request, c)
+	if der == nil {
+		err = ErrTokenCertificateRequired
+		return
+	}
+	sum := sha256.Sum256(der)
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != x5t {
+		err = ErrTokenCertificateMismatch
+		return
+	}
+	return
+}
+
+// 连接上的证书 优先,  其次 反向代理 转发的 header
+func clientCertificate(request *http.Request, c TokenConfig) []byte {
+	if request == nil {
+		return nil
+	}
+	if state := request.TLS; state != nil && len(state.PeerCertificates) != 0 {
+		return state.PeerCertificates[0].Raw
+	}
+	if c.CertificateHeader == "" {
+		return nil
+	}
+	return parseCertificateHeader(request.Header.Get(c.CertificateHeader))
+}
+
+// PEM (可能 URL 编码, nginx $ssl_client_escaped_cert),  Envoy XFCC Cert=  或 base64 DER
+func parseCertificateHeader(value string) []byte {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	if i := strings.Index(value, "Cert=\""); i != -1 {
+		value = value[i+6:]
+		if i = strings.Index(value, "\""); i != -1 {
+			value = value[:i]
+		}
+	}
+	// 没有 编码的 PEM 不包含 %.  PathUnescape 不会 把 base64 的 + 变成 空格,  只有 BEGIN END 行 的 + 是 空格
+	if strings.Contains(value, "%") {
+		if unescaped, err := url.PathUnescape(value); err == nil {
+			value = strings.NewReplacer("-----BEGIN+", "-----BEGIN ", "-----END+", "-----END ").Replace(unescaped)
+		}
+	}
+	if strings.Contains(value, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(value))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil
+		}
+		return block.Bytes
+	}
+	der, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	return der
+}
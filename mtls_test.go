@@ -0,0 +1,111 @@
+package model
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCertificate(t *testing.T) *x509.Certificate {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func TestParseCertificateHeader(t *testing.T) {
+	certificate := newTestCertificate(t)
+	pemString := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+	// base64 里 有 + 的 PEM
+	for !strings.Contains(pemString, "+") {
+		certificate = newTestCertificate(t)
+		pemString = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"pem", pemString, true},
+		{"escaped pem", url.QueryEscape(pemString), true},
+		{"path escaped pem", url.PathEscape(pemString), true},
+		{"xfcc", `By=spiffe://cluster.local/ns/default/sa/api;Hash=abc;Cert="` + url.QueryEscape(pemString) + `";Subject="CN=client";URI=`, true},
+		{"der", base64.StdEncoding.EncodeToString(certificate.Raw), true},
+		{"empty", "", false},
+		{"invalid", "not a certificate", false},
+		{"other pem", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: certificate.RawSubjectPublicKeyInfo})), false},
+	}
+	for _, test := range tests {
+		der := parseCertificateHeader(test.value)
+		if ok := der != nil && string(der) == string(certificate.Raw); ok != test.ok {
+			t.Errorf("%s: %t", test.name, ok)
+		}
+	}
+}
+
+func TestCheckCertificateBound(t *testing.T) {
+	certificate := newTestCertificate(t)
+	sum := sha256.Sum256(certificate.Raw)
+	x5t := base64.RawURLEncoding.EncodeToString(sum[:])
+	claims := &TokenClaims{Confirmation: &TokenConfirmation{X5TS256: x5t}}
+	c := TokenConfig{CertificateBound: true, CertificateHeader: "X-Client-Cert"}
+
+	// 连接上的 证书
+	request := httptest.NewRequest("GET", "https://api.example.com/", nil)
+	request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}
+	if err := checkCertificateBound(request, TokenConfig{CertificateBound: true}, claims); err != nil {
+		t.Fatal("tls", err)
+	}
+
+	// 反向代理 转发
+	request = httptest.NewRequest("GET", "http://api.example.com/", nil)
+	request.Header.Set("X-Client-Cert", url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))))
+	if err := checkCertificateBound(request, c, claims); err != nil {
+		t.Fatal("header", err)
+	}
+	// 没有 配置 header 不读取
+	if err := checkCertificateBound(request, TokenConfig{CertificateBound: true}, claims); err != ErrTokenCertificateRequired {
+		t.Fatal("header not configured", err)
+	}
+
+	// 其他 证书
+	other := &TokenClaims{Confirmation: &TokenConfirmation{X5TS256: base64.RawURLEncoding.EncodeToString(make([]byte, 32))}}
+	if err := checkCertificateBound(request, c, other); err != ErrTokenCertificateMismatch {
+		t.Fatal("x5t#S256 mismatch", err)
+	}
+	// 没有 绑定
+	if err := checkCertificateBound(request, c, &TokenClaims{}); err != ErrTokenCertificateMismatch {
+		t.Fatal("cnf", err)
+	}
+	if err := checkCertificateBound(httptest.NewRequest("GET", "/", nil), c, claims); err != ErrTokenCertificateRequired {
+		t.Fatal("required", err)
+	}
+}
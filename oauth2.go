@@ -4,17 +4,27 @@ import (
 	"context"
 	"net/http"
 
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 )
 
 func GetClientCredentials(scopes []string) (client *http.Client) {
+	return defaultAuth.GetClientCredentials(scopes)
+}
+
+func (auth *Auth) GetClientCredentials(scopes []string) (client *http.Client) {
+	options := auth.Options()
 	conf := clientcredentials.Config{
-		ClientID:     ClientID,
-		ClientSecret: ClientSecret,
-		TokenURL:     AuthOrigin + "/token",
+		ClientID:     options.ClientID,
+		ClientSecret: options.ClientSecret,
+		TokenURL:     options.AuthOrigin + "/token",
 		Scopes:       scopes,
 	}
-	client = conf.Client(context.Background())
+	ctx := context.Background()
+	if options.HTTPClient != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, options.HTTPClient)
+	}
+	client = conf.Client(ctx)
 	return
 }
 
@@ -0,0 +1,350 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/otamoe/gin-server/errs"
+	mgoModel "github.com/otamoe/mgo-model"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	Revocation struct {
+		mgoModel.DocumentBase `json:"-" bson:"-"`
+		ID                    bson.ObjectId `json:"_id" bson:"_id"`
+		TokenID               bson.ObjectId `json:"token_id,omitempty" bson:"token,omitempty"`
+		UserID                bson.ObjectId `json:"user_id,omitempty" bson:"user,omitempty"`
+		// 用户 在这个时间之前 签发的 token 全部作废
+		IssuedBefore *time.Time `json:"issued_before,omitempty" bson:"issued_before,omitempty"`
+		Reason       string     `json:"reason,omitempty" bson:"reason,omitempty"`
+		CreatedAt    *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
+		ExpiredAt    *time.Time `json:"expired_at,omitempty" bson:"expired_at,omitempty"`
+	}
+
+	Revocations struct {
+		Results []*Revocation `json:"results"`
+	}
+
+	revocationList struct {
+		sync.RWMutex
+		tokens map[bson.ObjectId]*time.Time
+		users  map[bson.ObjectId]userRevocation
+		// 没有 issued_before 和 created_at 的 同步记录 第一次 看到 的 时间,  重叠 同步 时 不往后 移动
+		seen map[bson.ObjectId]time.Time
+		time time.Time
+	}
+
+	userRevocation struct {
+		issuedBefore time.Time
+		// nil 不过期
+		expiredAt *time.Time
+	}
+)
+
+var (
+	ErrTokenRevoked error = &errs.Error{
+		Message:    "Token has been revoked",
+		Path:       "access_token",
+		Type:       "revoked",
+		StatusCode: http.StatusUnauthorized,
+	}
+
+	ErrRevocationRequired error = &errs.Error{
+		Message:    "Revocation token_id or user_id is required",
+		Path:       "revocation",
+		Type:       "required",
+		StatusCode: http.StatusBadRequest,
+	}
+)
+
+var ModelRevocation = &mgoModel.Model{
+	Name:     "revocations",
+	Document: &Revocation{},
+	Indexs: []mgo.Index{
+		mgo.Index{
+			Key:        []string{"token"},
+			Background: true,
+			Sparse:     true,
+		},
+		mgo.Index{
+			Key:        []string{"user", "issued_before"},
+			Background: true,
+			Sparse:     true,
+		},
+		mgo.Index{
+			Key:         []string{"expired_at"},
+			Background:  true,
+			ExpireAfter: time.Second,
+		},
+	},
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		tokens: map[bson.ObjectId]*time.Time{},
+		users:  map[bson.ObjectId]userRevocation{},
+		seen:   map[bson.ObjectId]time.Time{},
+	}
+}
+
+func AddRevocation(revocation *Revocation) (err error) {
+	return defaultAuth.AddRevocation(revocation)
+}
+
+func Revoke(ctx context.Context, revocation *Revocation) (err error) {
+	return defaultAuth.Revoke(ctx, revocation)
+}
+
+func RevokeToken(ctx context.Context, tokenID bson.ObjectId, expiredAt *time.Time, reason string) (err error) {
+	return defaultAuth.RevokeToken(ctx, tokenID, expiredAt, reason)
+}
+
+func RevokeUser(ctx context.Context, userID bson.ObjectId, issuedBefore time.Time, reason string) (err error) {
+	return defaultAuth.RevokeUser(ctx, userID, issuedBefore, reason)
+}
+
+// 只写入 本地 denylist
+func (auth *Auth) AddRevocation(revocation *Revocation) (err error) {
+	if revocation == nil || (!revocation.TokenID.Valid() && !revocation.UserID.Valid()) {
+		err = ErrRevocationRequired
+		return
+	}
+	auth.addRevocation(revocation)
+	return
+}
+
+// 先 写入 TokenStore 再 写入 本地 denylist,  MgoStore 时 ctx 需要 mongo session
+func (auth *Auth) Revoke(ctx context.Context, revocation *Revocation) (err error) {
+	if revocation == nil || (!revocation.TokenID.Valid() && !revocation.UserID.Valid()) {
+		err = ErrRevocationRequired
+		return
+	}
+	if revocation.UserID.Valid() && revocation.IssuedBefore == nil && !revocation.TokenID.Valid() {
+		now := time.Now()
+		revocation.IssuedBefore = &now
+	}
+	if revocation.CreatedAt == nil {
+		now := time.Now()
+		revocation.CreatedAt = &now
+	}
+	// 保存 失败 不写入 denylist,  调用方 可以 重试
+	if err = auth.tokenStore().InsertRevocation(ctx, revocation); err != nil {
+		return
+	}
+	auth.addRevocation(revocation)
+	return
+}
+
+func (auth *Auth) RevokeToken(ctx context.Context, tokenID bson.ObjectId, expiredAt *time.Time, reason string) (err error) {
+	return auth.Revoke(ctx, &Revocation{
+		TokenID:   tokenID,
+		ExpiredAt: expiredAt,
+		Reason:    reason,
+	})
+}
+
+func (auth *Auth) RevokeUser(ctx context.Context, userID bson.ObjectId, issuedBefore time.Time, reason string) (err error) {
+	return auth.Revoke(ctx, &Revocation{
+		UserID:       userID,
+		IssuedBefore: &issuedBefore,
+		Reason:       reason,
+	})
+}
+
+// 写入 denylist 并 清除 缓存
+func (auth *Auth) addRevocation(revocation *Revocation) {
+	auth.revocations.add(revocation)
+	if revocation.TokenID.Valid() {
+		auth.getTokenCache().Delete(revocation.TokenID.Hex())
+		auth.getRevocationCache().Delete(revocation.TokenID.Hex())
+	} else if revocation.UserID.Valid() {
+		auth.getRevocationCache().Purge()
+	}
+}
+
+func (list *revocationList) add(revocation *Revocation) {
+	list.Lock()
+	defer list.Unlock()
+	if revocation.TokenID.Valid() {
+		list.tokens[revocation.TokenID] = revocation.ExpiredAt
+	}
+	if revocation.UserID.Valid() && !revocation.TokenID.Valid() {
+		value := userRevocation{
+			issuedBefore: list.issuedBefore(revocation),
+			expiredAt:    revocation.ExpiredAt,
+		}
+		// 多个 记录 使用 最晚的 时间 和 最晚的 过期
+		if old, ok := list.users[revocation.UserID]; ok {
+			if old.issuedBefore.After(value.issuedBefore) {
+				value.issuedBefore = old.issuedBefore
+			}
+			if old.expiredAt == nil || (value.expiredAt != nil && old.expiredAt.After(*value.expiredAt)) {
+				value.expiredAt = old.expiredAt
+			}
+		}
+		list.users[revocation.UserID] = value
+	}
+}
+
+// IssuedBefore,  其次 CreatedAt,  都没有 使用 第一次 看到 的 时间
+func (list *revocationList) issuedBefore(revocation *Revocation) time.Time {
+	if revocation.IssuedBefore != nil {
+		return *revocation.IssuedBefore
+	}
+	if revocation.CreatedAt != nil {
+		return *revocation.CreatedAt
+	}
+	if seen, ok := list.seen[revocation.ID]; ok {
+		return seen
+	}
+	now := time.Now()
+	if revocation.ID.Valid() {
+		list.seen[revocation.ID] = now
+	}
+	return now
+}
+
+func (list *revocationList) revoked(tokenID bson.ObjectId, userID bson.ObjectId, issuedAt time.Time) bool {
+	list.RLock()
+	defer list.RUnlock()
+	if expiredAt, ok := list.tokens[tokenID]; ok && (expiredAt == nil || expiredAt.After(time.Now())) {
+		return true
+	}
+	if value, ok := list.users[userID]; ok && issuedAt.Before(value.issuedBefore) && (value.expiredAt == nil || value.expiredAt.After(time.Now())) {
+		return true
+	}
+	return false
+}
+
+func (list *revocationList) prune() {
+	now := time.Now()
+	list.Lock()
+	defer list.Unlock()
+	for tokenID, expiredAt := range list.tokens {
+		if expiredAt != nil && expiredAt.Before(now) {
+			delete(list.tokens, tokenID)
+		}
+	}
+	for userID, value := range list.users {
+		if value.expiredAt != nil && value.expiredAt.Before(now) {
+			delete(list.users, userID)
+		}
+	}
+	// 同步 只 重叠 一分钟,  之后 不会 再 收到 同一个 记录
+	for id, seen := range list.seen {
+		if seen.Before(now.Add(-time.Hour)) {
+			delete(list.seen, id)
+		}
+	}
+}
+
+// 本地 denylist,  开启 cache 时 再查询 TokenStore
+func (auth *Auth) checkTokenRevoked(ctx context.Context, cache bool, token *Token, claims *TokenClaims) (err error) {
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	if claims.IssuedAt == 0 && token.CreatedAt != nil {
+		issuedAt = *token.CreatedAt
+	}
+	if auth.revocations.revoked(token.ID, token.UserID, issuedAt) {
+		err = ErrTokenRevoked
+		return
+	}
+	if !cache {
+		return
+	}
+
+	key := token.ID.Hex()
+	if _, ok := auth.getRevocationCache().Get(key); ok {
+		return
+	}
+	var revoked bool
+	if revoked, err = auth.tokenStore().Revoked(ctx, token.ID, token.UserID, issuedAt); err != nil {
+		return
+	}
+	if revoked {
+		err = ErrTokenRevoked
+		return
+	}
+	if token.ID.Valid() {
+		auth.getRevocationCache().Set(key, true, token.ExpiredAt)
+	}
+	return
+}
+
+func (auth *Auth) requestRevocations(ctx context.Context, since time.Time) (value *Revocations, err error) {
+	revocationURL := auth.Options().RevocationURL
+	if revocationURL == "" {
+		err = errors.New("auth-model.RevocationURL variable not configured")
+		return
+	}
+	var request *http.Request
+	if request, err = http.NewRequest("GET", revocationURL, nil); err != nil {
+		return
+	}
+	if !since.IsZero() {
+		// 留一点 时钟误差
+		query := request.URL.Query()
+		query.Set("since", since.Add(-time.Minute).UTC().Format(time.RFC3339))
+		request.URL.RawQuery = query.Encode()
+	}
+
+	var statusCode int
+	var bodyBytes []byte
+	if statusCode, bodyBytes, err = auth.doUpstream(ctx, upstreamRevocations, request, 8<<20); err != nil {
+		return
+	}
+	logrus.Debugf("[REVOCATIONS] %d %d bytes", statusCode, len(bodyBytes))
+
+	if statusCode >= http.StatusMultipleChoices {
+		err = fmt.Errorf("Revocation request error status: %d", statusCode)
+		return
+	}
+	value = &Revocations{}
+	if err = json.Unmarshal(bodyBytes, value); err != nil {
+		return
+	}
+	return
+}
+
+func (auth *Auth) syncRevocations(ctx context.Context) (err error) {
+	revocations := auth.revocations
+	revocations.RLock()
+	since := revocations.time
+	revocations.RUnlock()
+
+	now := time.Now()
+	var value *Revocations
+	if value, err = auth.requestRevocations(ctx, since); err != nil {
+		return
+	}
+	for _, revocation := range value.Results {
+		if revocation == nil {
+			continue
+		}
+		auth.addRevocation(revocation)
+	}
+	revocations.prune()
+
+	revocations.Lock()
+	revocations.time = now
+	revocations.Unlock()
+	return
+}
+
+func (auth *Auth) runRevocations(ctx context.Context) {
+	for {
+		if err := auth.syncRevocations(ctx); err != nil {
+			logrus.Error("[REVOCATIONS]", err)
+		}
+		if !sleepContext(ctx, auth.revocationRefreshPeriod()) {
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+type failingRevocationStore struct {
+	*MemoryStore
+}
+
+func (failingRevocationStore) InsertRevocation(ctx context.Context, revocation *Revocation) error {
+	return errors.New("insert failed")
+}
+
+func TestRevocationList(t *testing.T) {
+	list := newRevocationList()
+	now := time.Now()
+	tokenID, userID := bson.NewObjectId(), bson.NewObjectId()
+	expiredAt := now.Add(-time.Second)
+	list.add(&Revocation{TokenID: tokenID})
+	list.add(&Revocation{TokenID: bson.NewObjectId(), ExpiredAt: &expiredAt})
+	list.add(&Revocation{UserID: userID, IssuedBefore: &now})
+
+	if !list.revoked(tokenID, bson.NewObjectId(), now) {
+		t.Fatal("token")
+	}
+	if !list.revoked(bson.NewObjectId(), userID, now.Add(-time.Minute)) {
+		t.Fatal("user issued before")
+	}
+	if list.revoked(bson.NewObjectId(), userID, now.Add(time.Minute)) {
+		t.Fatal("user issued after")
+	}
+	// 旧的 issued_before 不会 覆盖 新的
+	before := now.Add(-time.Hour)
+	list.add(&Revocation{UserID: userID, IssuedBefore: &before})
+	if !list.revoked(bson.NewObjectId(), userID, now.Add(-time.Minute)) {
+		t.Fatal("user issued before overwritten")
+	}
+	list.prune()
+	if len(list.tokens) != 1 {
+		t.Fatal("prune", list.tokens)
+	}
+}
+
+func TestRevokeStoreError(t *testing.T) {
+	store := failingRevocationStore{NewMemoryStore()}
+	auth := NewAuth(Options{TokenStore: store, UserStore: store})
+	tokenID := bson.NewObjectId()
+	if err := auth.RevokeToken(context.Background(), tokenID, nil, "test"); err == nil {
+		t.Fatal("RevokeToken")
+	}
+	if auth.revocations.revoked(tokenID, "", time.Now()) {
+		t.Fatal("denylist updated without store")
+	}
+	if err := auth.Revoke(context.Background(), &Revocation{}); err != ErrRevocationRequired {
+		t.Fatal("required", err)
+	}
+}
+
+func TestSyncRevocations(t *testing.T) {
+	tokenID := bson.NewObjectId()
+	var sinces []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sinces = append(sinces, r.URL.Query().Get("since"))
+		results := []*Revocation{}
+		if len(sinces) == 1 {
+			results = append(results, &Revocation{TokenID: tokenID})
+		}
+		json.NewEncoder(w).Encode(&Revocations{Results: results})
+	}))
+	defer server.Close()
+	auth := NewAuth(Options{RevocationURL: server.URL})
+	ctx := context.Background()
+
+	start := time.Now()
+	if err := auth.syncRevocations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !auth.revocations.revoked(tokenID, "", time.Now()) {
+		t.Fatal("revoked")
+	}
+	if err := auth.syncRevocations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(sinces) != 2 || sinces[0] != "" {
+		t.Fatal("since", sinces)
+	}
+	// 第二次 从 上次 同步 时间 减 一分钟 开始
+	since, err := time.Parse(time.RFC3339, sinces[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since.After(start.Add(-time.Minute)) || since.Before(start.Add(-time.Minute-time.Second*2)) {
+		t.Fatal("since", since, start)
+	}
+}
+
+// 同步 重叠 时 没有 issued_before 的 记录 不往后 移动,  过期 的 删除
+func TestSyncRevocationsUsers(t *testing.T) {
+	userID, expiredUserID := bson.NewObjectId(), bson.NewObjectId()
+	revocationID := bson.NewObjectId()
+	past := time.Now().Add(-time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&Revocations{Results: []*Revocation{
+			&Revocation{ID: revocationID, UserID: userID},
+			&Revocation{UserID: expiredUserID, IssuedBefore: &past, ExpiredAt: &past},
+		}})
+	}))
+	defer server.Close()
+	auth := NewAuth(Options{RevocationURL: server.URL})
+	ctx := context.Background()
+
+	if err := auth.syncRevocations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	issuedAt := time.Now().Add(time.Millisecond * 10)
+	if !auth.revocations.revoked("", userID, issuedAt.Add(-time.Second)) {
+		t.Fatal("revoked")
+	}
+	time.Sleep(time.Millisecond * 20)
+	if err := auth.syncRevocations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if auth.revocations.revoked("", userID, issuedAt) {
+		t.Fatal("issued after first sync")
+	}
+
+	if auth.revocations.revoked("", expiredUserID, past.Add(-time.Hour)) {
+		t.Fatal("expired")
+	}
+	if _, ok := auth.revocations.users[expiredUserID]; ok {
+		t.Fatal("prune")
+	}
+}
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// token 和 撤销记录 的存储
+	TokenStore interface {
+		// 包括 token.User,  不存在 返回 ErrNotFound
+		FindToken(ctx context.Context, id bson.ObjectId) (token *Token, err error)
+		// 已经存在 忽略
+		InsertToken(ctx context.Context, token *Token) (err error)
+		// 删除 expired_at 在 before 之前的 token
+		DeleteExpiredTokens(ctx context.Context, before time.Time) (n int, err error)
+
+		InsertRevocation(ctx context.Context, revocation *Revocation) (err error)
+		// token 被撤销 或 用户 撤销了 issuedAt 之前签发的 全部 token
+		Revoked(ctx context.Context, tokenID bson.ObjectId, userID bson.ObjectId, issuedAt time.Time) (revoked bool, err error)
+	}
+
+	// 用户 的存储
+	UserStore interface {
+		// 不存在 返回 ErrNotFound
+		FindUser(ctx context.Context, id bson.ObjectId) (user *User, err error)
+		// 插入 或 更新 用户资料 并设置 FetchedAt,  auth_types 只在插入时写入.  并发 重复 执行 结果一样
+		UpsertUser(ctx context.Context, user *User) (result *User, err error)
+	}
+)
+
+// 存储里 不存在,  和 mgo.ErrNotFound 相同 兼容以前的判断
+var ErrNotFound = mgo.ErrNotFound
+
+var (
+	// 默认 mgo,  ctx 需要 mongo session
+	TokenStorage TokenStore = MgoStore{}
+	UserStorage  UserStore  = MgoStore{}
+)
+
+// token 被撤销 或 用户 撤销了 issuedAt 之前签发的 token,  过期的 撤销记录 不算
+func revokedQuery(tokenID bson.ObjectId, userID bson.ObjectId, issuedAt time.Time, now time.Time) bson.M {
+	return bson.M{
+		"$and": []bson.M{
+			bson.M{
+				"$or": []bson.M{
+					bson.M{"token": tokenID},
+					bson.M{"user": userID, "issued_before": bson.M{"$gt": issuedAt}},
+				},
+			},
+			bson.M{
+				"$or": []bson.M{
+					bson.M{"expired_at": nil},
+					bson.M{"expired_at": bson.M{"$gt": now}},
+				},
+			},
+		},
+	}
+}
+
+// 同时 设置 token 和 用户 存储
+func ConfigStore(tokens TokenStore, users UserStore) {
+	TokenStorage = tokens
+	UserStorage = users
+}
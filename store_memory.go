@@ -0,0 +1,128 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// 进程内 存储,  用于 测试 和 不需要 数据库 的部署.  保存 和 返回的 都是 副本
+type MemoryStore struct {
+	sync.RWMutex
+	tokens      map[bson.ObjectId]*Token
+	users       map[bson.ObjectId]*User
+	revocations []*Revocation
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tokens: map[bson.ObjectId]*Token{},
+		users:  map[bson.ObjectId]*User{},
+	}
+}
+
+func (store *MemoryStore) FindToken(ctx context.Context, id bson.ObjectId) (token *Token, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	value, ok := store.tokens[id]
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	token = value.clone()
+	token.User = nil
+	if user, ok := store.users[token.UserID]; ok {
+		token.User = user.clone()
+	}
+	return
+}
+
+func (store *MemoryStore) InsertToken(ctx context.Context, token *Token) (err error) {
+	if token.ID == "" {
+		token.ID = bson.NewObjectId()
+	}
+	store.Lock()
+	defer store.Unlock()
+	if _, ok := store.tokens[token.ID]; ok {
+		return
+	}
+	value := token.clone()
+	value.User = nil
+	store.tokens[token.ID] = value
+	return
+}
+
+func (store *MemoryStore) DeleteExpiredTokens(ctx context.Context, before time.Time) (n int, err error) {
+	store.Lock()
+	defer store.Unlock()
+	for id, token := range store.tokens {
+		if token.ExpiredAt != nil && token.ExpiredAt.Before(before) {
+			delete(store.tokens, id)
+			n++
+		}
+	}
+	return
+}
+
+func (store *MemoryStore) InsertRevocation(ctx context.Context, revocation *Revocation) (err error) {
+	if revocation.ID == "" {
+		revocation.ID = bson.NewObjectId()
+	}
+	value := *revocation
+	store.Lock()
+	defer store.Unlock()
+	store.revocations = append(store.revocations, &value)
+	return
+}
+
+func (store *MemoryStore) Revoked(ctx context.Context, tokenID bson.ObjectId, userID bson.ObjectId, issuedAt time.Time) (revoked bool, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	now := time.Now()
+	for _, revocation := range store.revocations {
+		if revocation.ExpiredAt != nil && revocation.ExpiredAt.Before(now) {
+			continue
+		}
+		if revocation.TokenID.Valid() && revocation.TokenID == tokenID {
+			return true, nil
+		}
+		if revocation.UserID.Valid() && revocation.UserID == userID && revocation.IssuedBefore != nil && revocation.IssuedBefore.After(issuedAt) {
+			return true, nil
+		}
+	}
+	return
+}
+
+func (store *MemoryStore) FindUser(ctx context.Context, id bson.ObjectId) (user *User, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	value, ok := store.users[id]
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	user = value.clone()
+	return
+}
+
+func (store *MemoryStore) UpsertUser(ctx context.Context, user *User) (result *User, err error) {
+	if !user.ID.Valid() {
+		err = ErrUserIDRequired
+		return
+	}
+	fetchedAt := time.Now()
+	value := user.clone()
+	value.FetchedAt = &fetchedAt
+
+	store.Lock()
+	defer store.Unlock()
+	// auth_types 只在插入时写入
+	if old, ok := store.users[user.ID]; ok {
+		value.AuthTypes = old.AuthTypes
+	}
+	store.users[user.ID] = value
+	result = value.clone()
+	return
+}
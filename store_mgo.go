@@ -0,0 +1,120 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	mgoModel "github.com/otamoe/mgo-model"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// globalsign/mgo 存储,  使用 ModelToken ModelUser ModelRevocation,  ctx 需要 mongo session
+type MgoStore struct{}
+
+// net/http gRPC 没有 设置 mongo session 时 返回,  不 panic
+var ErrMongoSessionMissing = errors.New("mongo session missing")
+
+func checkMgoSession(ctx context.Context) (err error) {
+	if session, ok := ctx.Value(mgoModel.CONTEXT).(*mgo.Session); !ok || session == nil {
+		err = ErrMongoSessionMissing
+	}
+	return
+}
+
+func (MgoStore) FindToken(ctx context.Context, id bson.ObjectId) (token *Token, err error) {
+	if err = checkMgoSession(ctx); err != nil {
+		return
+	}
+	token = &Token{}
+	if err = ModelToken.Query(ctx).ID(id).One(token); err != nil {
+		token = nil
+		return
+	}
+	// 单独 populate,  trace 里 可以 区分
+	ctx, span := startSpan(ctx, "auth.PopulatePath", attribute.String("auth.populate.path", "User"))
+	err = mgoModel.Populate{"User": ModelUser.Query(ctx)}.One(token)
+	endSpan(span, err)
+	if err != nil {
+		token = nil
+	}
+	return
+}
+
+func (MgoStore) InsertToken(ctx context.Context, token *Token) (err error) {
+	if err = checkMgoSession(ctx); err != nil {
+		return
+	}
+	token.New(ctx, ModelToken, token, true)
+	if err = token.Save(); err != nil && mgo.IsDup(err) {
+		err = nil
+	}
+	return
+}
+
+func (MgoStore) DeleteExpiredTokens(ctx context.Context, before time.Time) (n int, err error) {
+	if err = checkMgoSession(ctx); err != nil {
+		return
+	}
+	return ModelToken.Query(ctx).Lt("expired_at", before).ForceDeleteAll()
+}
+
+func (MgoStore) InsertRevocation(ctx context.Context, revocation *Revocation) (err error) {
+	if err = checkMgoSession(ctx); err != nil {
+		return
+	}
+	revocation.New(ctx, ModelRevocation, revocation, true)
+	return revocation.Save()
+}
+
+func (MgoStore) Revoked(ctx context.Context, tokenID bson.ObjectId, userID bson.ObjectId, issuedAt time.Time) (revoked bool, err error) {
+	if err = checkMgoSession(ctx); err != nil {
+		return
+	}
+	var n int
+	if n, err = ModelRevocation.Query(ctx).Find(revokedQuery(tokenID, userID, issuedAt, time.Now())).Count(); err != nil {
+		return
+	}
+	revoked = n != 0
+	return
+}
+
+func (MgoStore) FindUser(ctx context.Context, id bson.ObjectId) (user *User, err error) {
+	if err = checkMgoSession(ctx); err != nil {
+		return
+	}
+	user = &User{}
+	if err = ModelUser.Query(ctx).ID(id).One(user); err != nil {
+		user = nil
+		return
+	}
+	return
+}
+
+func (MgoStore) UpsertUser(ctx context.Context, user *User) (result *User, err error) {
+	if !user.ID.Valid() {
+		err = ErrUserIDRequired
+		return
+	}
+	if err = checkMgoSession(ctx); err != nil {
+		return
+	}
+	result = &User{}
+	change := mgo.Change{
+		Update:    user.upsertUpdate(time.Now()),
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	if _, err = ModelUser.DB(ctx).FindId(user.ID).Apply(change, result); err != nil {
+		if !mgo.IsDup(err) {
+			return
+		}
+		// 并发 upsert 同一个 _id,  再执行一次 就是 更新
+		if _, err = ModelUser.DB(ctx).FindId(user.ID).Apply(change, result); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,273 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	mongoBson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/mgocompat"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// 官方 MongoDB driver 存储,  和 MgoStore 使用 同样的 集合 和 文档格式
+	MongoStore struct {
+		Tokens      *mongo.Collection
+		Users       *mongo.Collection
+		Revocations *mongo.Collection
+
+		// CreateIndexes 的 TTL,  和 Options.TokenExpireGrace 一样 0 是 1 小时
+		TokenExpireGrace time.Duration
+	}
+
+	// listIndexes 返回的 索引
+	mongoIndex struct {
+		Name               string `bson:"name"`
+		ExpireAfterSeconds *int64 `bson:"expireAfterSeconds"`
+		Sparse             bool   `bson:"sparse"`
+	}
+)
+
+var typeObjectId = reflect.TypeOf(bson.ObjectId(""))
+
+// mgo 兼容的 registry,  bson.ObjectId 编码成 ObjectID
+var mongoRegistry = func() *bsoncodec.Registry {
+	registry := mgocompat.NewRegistryBuilder().Build()
+	registry.RegisterTypeEncoder(typeObjectId, bsoncodec.ValueEncoderFunc(encodeObjectId))
+	registry.RegisterTypeDecoder(typeObjectId, bsoncodec.ValueDecoderFunc(decodeObjectId))
+	return registry
+}()
+
+func NewMongoStore(database *mongo.Database) *MongoStore {
+	collectionOptions := options.Collection().SetRegistry(mongoRegistry)
+	return &MongoStore{
+		Tokens:      database.Collection(ModelToken.Name, collectionOptions),
+		Users:       database.Collection(ModelUser.Name, collectionOptions),
+		Revocations: database.Collection(ModelRevocation.Name, collectionOptions),
+	}
+}
+
+func encodeObjectId(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	id := val.String()
+	if id == "" {
+		return vw.WriteNull()
+	}
+	if len(id) != 12 {
+		return fmt.Errorf("ObjectIDs must be exactly 12 bytes long (got %d)", len(id))
+	}
+	var objectID primitive.ObjectID
+	copy(objectID[:], id)
+	return vw.WriteObjectID(objectID)
+}
+
+func decodeObjectId(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	switch vr.Type() {
+	case bsontype.ObjectID:
+		objectID, err := vr.ReadObjectID()
+		if err != nil {
+			return err
+		}
+		val.SetString(string(objectID[:]))
+	case bsontype.Null:
+		if err := vr.ReadNull(); err != nil {
+			return err
+		}
+		val.SetString("")
+	case bsontype.String:
+		s, err := vr.ReadString()
+		if err != nil {
+			return err
+		}
+		if !bson.IsObjectIdHex(s) {
+			return fmt.Errorf("invalid ObjectId hex %q", s)
+		}
+		val.SetString(string(bson.ObjectIdHex(s)))
+	default:
+		return fmt.Errorf("cannot decode %v into a bson.ObjectId", vr.Type())
+	}
+	return nil
+}
+
+// 和 ModelToken ModelRevocation 一样的 索引
+func (store *MongoStore) CreateIndexes(ctx context.Context, ttl bool) (err error) {
+	expiredAt := options.Index()
+	if ttl {
+		expiredAt.SetExpireAfterSeconds(int32(tokenTTLGrace(store.TokenExpireGrace) / time.Second))
+	}
+	if err = createMongoIndexes(ctx, store.Tokens, []mongo.IndexModel{
+		mongo.IndexModel{Keys: mongoBson.D{{Key: "user", Value: 1}}},
+		mongo.IndexModel{Keys: mongoBson.D{{Key: "created_at", Value: 1}}},
+		mongo.IndexModel{Keys: mongoBson.D{{Key: "expired_at", Value: 1}}, Options: expiredAt},
+	}); err != nil {
+		return
+	}
+	if err = createMongoIndexes(ctx, store.Revocations, []mongo.IndexModel{
+		mongo.IndexModel{Keys: mongoBson.D{{Key: "token", Value: 1}}, Options: options.Index().SetSparse(true)},
+		mongo.IndexModel{Keys: mongoBson.D{{Key: "user", Value: 1}, {Key: "issued_before", Value: 1}}, Options: options.Index().SetSparse(true)},
+		mongo.IndexModel{Keys: mongoBson.D{{Key: "expired_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(1)},
+	}); err != nil {
+		return
+	}
+	return
+}
+
+// 和 mgo-model Update 一样,  同名 索引 的 TTL 或 sparse 不同 时 先 删除 再 创建,  不然 IndexOptionsConflict
+func createMongoIndexes(ctx context.Context, collection *mongo.Collection, models []mongo.IndexModel) (err error) {
+	var cursor *mongo.Cursor
+	if cursor, err = collection.Indexes().List(ctx); err != nil {
+		return
+	}
+	var indexes []*mongoIndex
+	if err = cursor.All(ctx, &indexes); err != nil {
+		return
+	}
+	for _, name := range conflictingMongoIndexes(indexes, models) {
+		if _, err = collection.Indexes().DropOne(ctx, name); err != nil {
+			return
+		}
+	}
+	_, err = collection.Indexes().CreateMany(ctx, models)
+	return
+}
+
+func conflictingMongoIndexes(indexes []*mongoIndex, models []mongo.IndexModel) (names []string) {
+	existing := map[string]*mongoIndex{}
+	for _, index := range indexes {
+		existing[index.Name] = index
+	}
+	for _, model := range models {
+		name := mongoIndexName(model)
+		index, ok := existing[name]
+		if !ok {
+			continue
+		}
+		var expireAfterSeconds *int32
+		var sparse bool
+		if model.Options != nil {
+			expireAfterSeconds = model.Options.ExpireAfterSeconds
+			sparse = model.Options.Sparse != nil && *model.Options.Sparse
+		}
+		switch {
+		case (index.ExpireAfterSeconds == nil) != (expireAfterSeconds == nil):
+		case index.ExpireAfterSeconds != nil && *index.ExpireAfterSeconds != int64(*expireAfterSeconds):
+		case index.Sparse != sparse:
+		default:
+			continue
+		}
+		names = append(names, name)
+	}
+	return
+}
+
+// 默认 名称 "user_1_issued_before_1"
+func mongoIndexName(model mongo.IndexModel) (name string) {
+	if model.Options != nil && model.Options.Name != nil {
+		return *model.Options.Name
+	}
+	for _, key := range model.Keys.(mongoBson.D) {
+		if name != "" {
+			name += "_"
+		}
+		name += fmt.Sprintf("%s_%v", key.Key, key.Value)
+	}
+	return
+}
+
+func (store *MongoStore) FindToken(ctx context.Context, id bson.ObjectId) (token *Token, err error) {
+	token = &Token{}
+	if err = store.Tokens.FindOne(ctx, bson.M{"_id": id}).Decode(token); err != nil {
+		token = nil
+		if err == mongo.ErrNoDocuments {
+			err = ErrNotFound
+		}
+		return
+	}
+	if token.UserID.Valid() {
+		var user *User
+		if user, err = store.FindUser(ctx, token.UserID); err != nil {
+			if err != ErrNotFound {
+				token = nil
+				return
+			}
+			err = nil
+		}
+		token.User = user
+	}
+	return
+}
+
+func (store *MongoStore) InsertToken(ctx context.Context, token *Token) (err error) {
+	if token.ID == "" {
+		token.ID = bson.NewObjectId()
+	}
+	if _, err = store.Tokens.InsertOne(ctx, token); err != nil && mongo.IsDuplicateKeyError(err) {
+		err = nil
+	}
+	return
+}
+
+func (store *MongoStore) DeleteExpiredTokens(ctx context.Context, before time.Time) (n int, err error) {
+	var result *mongo.DeleteResult
+	if result, err = store.Tokens.DeleteMany(ctx, bson.M{"expired_at": bson.M{"$lt": before}}); err != nil {
+		return
+	}
+	n = int(result.DeletedCount)
+	return
+}
+
+func (store *MongoStore) InsertRevocation(ctx context.Context, revocation *Revocation) (err error) {
+	if revocation.ID == "" {
+		revocation.ID = bson.NewObjectId()
+	}
+	_, err = store.Revocations.InsertOne(ctx, revocation)
+	return
+}
+
+func (store *MongoStore) Revoked(ctx context.Context, tokenID bson.ObjectId, userID bson.ObjectId, issuedAt time.Time) (revoked bool, err error) {
+	var n int64
+	if n, err = store.Revocations.CountDocuments(ctx, revokedQuery(tokenID, userID, issuedAt, time.Now())); err != nil {
+		return
+	}
+	revoked = n != 0
+	return
+}
+
+func (store *MongoStore) FindUser(ctx context.Context, id bson.ObjectId) (user *User, err error) {
+	user = &User{}
+	if err = store.Users.FindOne(ctx, bson.M{"_id": id}).Decode(user); err != nil {
+		user = nil
+		if err == mongo.ErrNoDocuments {
+			err = ErrNotFound
+		}
+		return
+	}
+	return
+}
+
+func (store *MongoStore) UpsertUser(ctx context.Context, user *User) (result *User, err error) {
+	if !user.ID.Valid() {
+		err = ErrUserIDRequired
+		return
+	}
+	update := user.upsertUpdate(time.Now())
+	findOptions := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	result = &User{}
+	if err = store.Users.FindOneAndUpdate(ctx, bson.M{"_id": user.ID}, update, findOptions).Decode(result); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			return
+		}
+		// 并发 upsert 同一个 _id,  再执行一次 就是 更新
+		if err = store.Users.FindOneAndUpdate(ctx, bson.M{"_id": user.ID}, update, findOptions).Decode(result); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,197 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	mongoBson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	user, err := store.UpsertUser(ctx, &User{ID: bson.NewObjectId(), Username: "a", AuthTypes: []string{"password"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.FetchedAt == nil {
+		t.Fatal("FetchedAt")
+	}
+	// auth_types 只在插入时写入
+	if user, err = store.UpsertUser(ctx, &User{ID: user.ID, Username: "b", AuthTypes: []string{"oauth"}}); err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "b" || len(user.AuthTypes) != 1 || user.AuthTypes[0] != "password" {
+		t.Fatal("UpsertUser", user)
+	}
+
+	expiredAt := time.Now().Add(-time.Hour * 2)
+	token := &Token{Type: "access", UserID: user.ID, ExpiredAt: &expiredAt}
+	if err = store.InsertToken(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	found, err := store.FindToken(ctx, token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.User == nil || found.User.Username != "b" {
+		t.Fatal("FindToken user", found.User)
+	}
+
+	now := time.Now()
+	if err = store.InsertRevocation(ctx, &Revocation{UserID: user.ID, IssuedBefore: &now}); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _ := store.Revoked(ctx, token.ID, user.ID, now.Add(-time.Minute)); !revoked {
+		t.Fatal("Revoked")
+	}
+	if revoked, _ := store.Revoked(ctx, token.ID, user.ID, now.Add(time.Minute)); revoked {
+		t.Fatal("Revoked after")
+	}
+
+	if n, _ := store.DeleteExpiredTokens(ctx, time.Now().Add(-time.Hour)); n != 1 {
+		t.Fatal("DeleteExpiredTokens", n)
+	}
+	if _, err = store.FindToken(ctx, token.ID); err != ErrNotFound {
+		t.Fatal("FindToken", err)
+	}
+}
+
+func TestMongoRegistry(t *testing.T) {
+	token := &Token{ID: bson.NewObjectId(), Type: "access", UserID: bson.NewObjectId()}
+	data, err := mongoBson.MarshalWithRegistry(mongoRegistry, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := mongoBson.Raw(data)
+	if _, ok := raw.Lookup("_id").ObjectIDOK(); !ok {
+		t.Fatal("_id is not an ObjectID", raw)
+	}
+	if raw.Lookup("application").Type != mongoBson.TypeNull {
+		t.Fatal("application", raw)
+	}
+
+	value := &Token{}
+	if err = mongoBson.UnmarshalWithRegistry(mongoRegistry, data, value); err != nil {
+		t.Fatal(err)
+	}
+	if value.ID != token.ID || value.UserID != token.UserID || value.ApplicationID != "" {
+		t.Fatal("Unmarshal", value)
+	}
+}
+
+func TestMgoStoreSessionMissing(t *testing.T) {
+	ctx := context.Background()
+	store := MgoStore{}
+	id := bson.NewObjectId()
+	if _, err := store.FindToken(ctx, id); err != ErrMongoSessionMissing {
+		t.Fatal("FindToken", err)
+	}
+	if err := store.InsertToken(ctx, &Token{ID: id}); err != ErrMongoSessionMissing {
+		t.Fatal("InsertToken", err)
+	}
+	if _, err := store.DeleteExpiredTokens(ctx, time.Now()); err != ErrMongoSessionMissing {
+		t.Fatal("DeleteExpiredTokens", err)
+	}
+	if err := store.InsertRevocation(ctx, &Revocation{TokenID: id}); err != ErrMongoSessionMissing {
+		t.Fatal("InsertRevocation", err)
+	}
+	if _, err := store.Revoked(ctx, id, id, time.Now()); err != ErrMongoSessionMissing {
+		t.Fatal("Revoked", err)
+	}
+	if _, err := store.FindUser(ctx, id); err != ErrMongoSessionMissing {
+		t.Fatal("FindUser", err)
+	}
+	if _, err := store.UpsertUser(ctx, &User{ID: id}); err != ErrMongoSessionMissing {
+		t.Fatal("UpsertUser", err)
+	}
+
+	// 默认 存储 的 net/http 中间件
+	recorder := httptest.NewRecorder()
+	NewAuth(Options{}).UserHTTPMiddleware(UserConfig{Cache: true}, func(r *http.Request) string {
+		return id.Hex()
+	})(http.NotFoundHandler()).ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatal("UserHTTPMiddleware", recorder.Code)
+	}
+}
+
+func TestConflictingMongoIndexes(t *testing.T) {
+	ttl := int64(3600)
+	indexes := []*mongoIndex{
+		{Name: "_id_"},
+		{Name: "user_1"},
+		{Name: "expired_at_1"},
+		{Name: "token_1", Sparse: true},
+	}
+	models := []mongo.IndexModel{
+		{Keys: mongoBson.D{{Key: "user", Value: 1}}},
+		{Keys: mongoBson.D{{Key: "expired_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(ttl))},
+		{Keys: mongoBson.D{{Key: "token", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: mongoBson.D{{Key: "created_at", Value: 1}}},
+	}
+	// 没有 TTL 的 expired_at_1 已经 存在
+	if names := conflictingMongoIndexes(indexes, models); len(names) != 1 || names[0] != "expired_at_1" {
+		t.Fatal("ttl", names)
+	}
+	indexes[2].ExpireAfterSeconds = &ttl
+	if names := conflictingMongoIndexes(indexes, models); len(names) != 0 {
+		t.Fatal("same", names)
+	}
+	// 关闭 TTL
+	models[1].Options = nil
+	if names := conflictingMongoIndexes(indexes, models); len(names) != 1 || names[0] != "expired_at_1" {
+		t.Fatal("no ttl", names)
+	}
+}
+
+// 需要 MONGODB_URI
+func TestMongoStoreCreateIndexes(t *testing.T) {
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		t.Skip("MONGODB_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	database := client.Database("auth_model_test_" + bson.NewObjectId().Hex())
+	defer database.Drop(ctx)
+	store := NewMongoStore(database)
+	store.TokenExpireGrace = time.Minute * 10
+
+	// mgo-model 或 之前 没有 TTL 创建的 索引
+	if _, err = store.Tokens.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: mongoBson.D{{Key: "expired_at", Value: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateIndexes(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := store.Tokens.Indexes().List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes []*mongoIndex
+	if err = cursor.All(ctx, &indexes); err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range indexes {
+		if index.Name == "expired_at_1" {
+			if index.ExpireAfterSeconds == nil || *index.ExpireAfterSeconds != 600 {
+				t.Fatal("ttl", index.ExpireAfterSeconds)
+			}
+			return
+		}
+	}
+	t.Fatal("expired_at_1 not found", indexes)
+}
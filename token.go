@@ -1,6 +1,7 @@
 package model
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -8,12 +9,14 @@ import (
 	"strings"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/otamoe/gin-server/errs"
 	ginResource "github.com/otamoe/gin-server/resource"
 	"github.com/otamoe/gin-server/scope"
 	mgoModel "github.com/otamoe/mgo-model"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type (
@@ -28,6 +31,18 @@ type (
 		UserScopes            []*UserScope  `json:"user_scopes,omitempty" bson:"user_scopes,omitempty"`
 		CreatedAt             *time.Time    `json:"created_at,omitempty" bson:"created_at"`
 		ExpiredAt             *time.Time    `json:"expired_at,omitempty" bson:"expired_at"`
+
+		// 内省 的 OAuth scope,  空格 分隔 的 "type:action",  没有 UserScopes 时 用于 ValidateScope
+		Scope string `json:"scope,omitempty" bson:"-"`
+		// 内省 的 sub 和 client_id 原始值,  不是 ObjectId 时 UserID ClientID 为空
+		Subject string `json:"sub,omitempty" bson:"-"`
+		Client  string `json:"client,omitempty" bson:"-"`
+
+		// 验证时 JWT 的 iss.  保存的 是 RegisterIssuer 的 Options.Issuer,  主 Auth 为空
+		Issuer string `json:"iss,omitempty" bson:"iss,omitempty"`
+
+		// 验证 这个 token 的 Auth
+		auth *Auth `json:"-" bson:"-"`
 	}
 	UserScope struct {
 		Scope     *Scope     `json:"scope,omitempty" bson:"scope,omitempty"`
@@ -78,7 +93,19 @@ var (
 var ModelToken = &mgoModel.Model{
 	Name:     "tokens",
 	Document: &Token{},
-	Indexs: []mgo.Index{
+	Indexs:   tokenIndexs(TokenExpireGrace, false),
+}
+
+func tokenIndexs(grace time.Duration, ttl bool) []mgo.Index {
+	expiredAt := mgo.Index{
+		Key:        []string{"expired_at"},
+		Background: true,
+	}
+	// TTL 索引  过期 grace 后 mongo 自动删除
+	if ttl {
+		expiredAt.ExpireAfter = tokenTTLGrace(grace)
+	}
+	return []mgo.Index{
 		mgo.Index{
 			Key:        []string{"user"},
 			Background: true,
@@ -87,14 +114,104 @@ var ModelToken = &mgoModel.Model{
 			Key:        []string{"created_at"},
 			Background: true,
 		},
-		mgo.Index{
-			Key:        []string{"expired_at"},
-			Background: true,
-		},
-	},
+		expiredAt,
+	}
+}
+
+// 在 ModelToken.Update 之前调用.  ttl=true 使用 TTL 索引,  mongo 会 删除 已有的 过期 token,  默认 不开启.  ttl=false 时 可以 使用 Handle.SweepTokens
+func ConfigTokenExpiry(grace time.Duration, ttl bool) {
+	TokenExpireGrace = grace
+	ModelToken.Indexs = tokenIndexs(grace, ttl)
+}
+
+func PurgeExpiredTokens(ctx context.Context) (n int, err error) {
+	return defaultAuth.PurgeExpiredTokens(ctx)
 }
 
+// 删除 过期 Options.TokenExpireGrace 之后的 token,  MgoStore 时 ctx 需要 mongo session
+func (auth *Auth) PurgeExpiredTokens(ctx context.Context) (n int, err error) {
+	return auth.tokenStore().DeleteExpiredTokens(ctx, time.Now().Add(-auth.tokenExpireGrace()))
+}
+
+// 0 是 1 小时,  小于 0 是 0
+func tokenExpireGrace(grace time.Duration) time.Duration {
+	if grace == 0 {
+		return time.Hour
+	}
+	if grace < 0 {
+		return 0
+	}
+	return grace
+}
+
+// TTL 索引 最少 1 秒
+func tokenTTLGrace(grace time.Duration) time.Duration {
+	if grace = tokenExpireGrace(grace); grace < time.Second {
+		return time.Second
+	}
+	return grace
+}
+
+// scope.Interface,  没有 ctx,  span 没有 父 span.  gin 使用 ScopeMiddleware 代替 scope.Middleware
 func (token *Token) ValidateScope(resource *ginResource.Resource) (params map[string]interface{}, err error) {
+	return token.ValidateScopeContext(context.Background(), resource)
+}
+
+// ctx 用于 trace
+func (token *Token) ValidateScopeContext(ctx context.Context, resource *ginResource.Resource) (params map[string]interface{}, err error) {
+	auth := token.getAuth()
+	_, span := auth.startSpan(ctx, "auth.ValidateScope",
+		attribute.String("auth.application", resource.Application.Hex()),
+		attribute.String("auth.type", resource.Type),
+		attribute.String("auth.action", resource.Action),
+	)
+	var match scopeMatch
+	params, match, err = token.validateScope(resource)
+	auth.metrics.scopeDecision(resource, err)
+	auth.audit(ctx, token, resource, match, err)
+	span.SetAttributes(attribute.String("auth.decision", scopeDecision(err)), attribute.String("auth.reason", match.reason))
+	endSpan(span, err)
+	return
+}
+
+// 和 scope.Middleware 一样,  *Token 使用 ValidateScopeContext,  span 的 父 span 和 AuditSink 的 ctx 是 gin 请求
+func ScopeMiddleware(required bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var err error
+		var params map[string]interface{}
+		if val, ok := ctx.Get(CONTEXT_TOKEN); ok {
+			resource := ctx.MustGet(ginResource.CONTEXT).(*ginResource.Resource)
+			resource.Pre()
+			if token, ok := val.(*Token); ok {
+				params, err = token.ValidateScopeContext(ctx, resource)
+			} else {
+				params, err = val.(scope.Interface).ValidateScope(resource)
+			}
+		} else {
+			err = scope.ErrRequired
+		}
+		if params == nil {
+			params = map[string]interface{}{}
+		}
+		ctx.Set(scope.CONTEXT_PARAMS, params)
+		ctx.Set(scope.CONTEXT_ERROR, err)
+		if err != nil && required {
+			ctx.Error(err)
+			ctx.Abort()
+		} else {
+			ctx.Next()
+		}
+	}
+}
+
+func (token *Token) getAuth() *Auth {
+	if token.auth != nil {
+		return token.auth
+	}
+	return defaultAuth
+}
+
+func (token *Token) validateScope(resource *ginResource.Resource) (params map[string]interface{}, match scopeMatch, err error) {
 	now := time.Now()
 	scopes := SortScopes{}
 
@@ -124,6 +241,11 @@ func (token *Token) ValidateScope(resource *ginResource.Resource) (params map[st
 
 	sort.Sort(scopes)
 
+	match.reason = AuditReasonNoScope
+	if len(scopes) != 0 {
+		match.reason = AuditReasonNoRole
+	}
+
 	authTypes := []string{}
 	if token.User != nil && token.User.AuthTypes != nil {
 		authTypes = token.User.AuthTypes
@@ -131,7 +253,7 @@ func (token *Token) ValidateScope(resource *ginResource.Resource) (params map[st
 	sort.Strings(authTypes)
 
 	for _, scope := range scopes {
-		for _, scopeRole := range scope.Roles {
+		for i, scopeRole := range scope.Roles {
 			// 规则没使用
 			if scopeRole.Status == "pending" {
 				continue
@@ -174,13 +296,14 @@ func (token *Token) ValidateScope(resource *ginResource.Resource) (params map[st
 			}
 
 			// 资源
-			if scopeRole.Type == "*" || scopeRole.Type == resource.Type {
-
-			} else if matched, _ := regexp.MatchString("^"+strings.Replace(regexp.QuoteMeta(scopeRole.Type), "\\*", ".*", -1)+"$", resource.Type); !matched {
+			if !matchScopeType(scopeRole.Type, resource.Type) {
 				continue
 			}
 
+			level, role := scope.Level, i
+			match = scopeMatch{level: &level, role: &role, reason: AuditReasonBanned}
 			if scopeRole.Status == "approved" {
+				match.reason = AuditReasonApproved
 				params = scopeRole.Params
 				return
 			}
@@ -188,6 +311,10 @@ func (token *Token) ValidateScope(resource *ginResource.Resource) (params map[st
 		}
 	}
 
+	if match.reason != AuditReasonBanned && token.validateOAuthScope(resource, &match) {
+		return
+	}
+
 	errParams := bson.M{"action": resource.Action, "type": resource.Type, "application_id": resource.Application}
 
 	if resource.Owner.Valid() {
@@ -203,6 +330,38 @@ func (token *Token) ValidateScope(resource *ginResource.Resource) (params map[st
 	return
 }
 
+// OAuth scope "type:action",  * 匹配 全部.  只能 访问 没有 owner 或 自己 的 资源
+func (token *Token) validateOAuthScope(resource *ginResource.Resource, match *scopeMatch) bool {
+	if resource.Owner.Valid() && (!token.UserID.Valid() || token.UserID != resource.Owner) {
+		return false
+	}
+	for i, value := range strings.Fields(token.Scope) {
+		j := strings.LastIndex(value, ":")
+		if j == -1 {
+			continue
+		}
+		if action := value[j+1:]; action != resource.Action && action != "*" {
+			continue
+		}
+		if !matchScopeType(value[:j], resource.Type) {
+			continue
+		}
+		role := i
+		*match = scopeMatch{role: &role, reason: AuditReasonApproved}
+		return true
+	}
+	return false
+}
+
+// * 是 通配符
+func matchScopeType(pattern string, value string) bool {
+	if pattern == "*" || pattern == value {
+		return true
+	}
+	matched, _ := regexp.MatchString("^"+strings.Replace(regexp.QuoteMeta(pattern), "\\*", ".*", -1)+"$", value)
+	return matched
+}
+
 func (scopes SortScopes) Len() int {
 	return len(scopes)
 }
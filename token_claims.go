@@ -0,0 +1,95 @@
+package model
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/otamoe/gin-server/errs"
+)
+
+type ClaimStrings []string
+
+var (
+	ErrTokenNotValidYet error = &errs.Error{
+		Message:    "Token is not valid yet",
+		Path:       "access_token",
+		Type:       "not_valid_yet",
+		StatusCode: http.StatusUnauthorized,
+	}
+	ErrTokenIssuer error = &errs.Error{
+		Message:    "Token issuer is not allowed",
+		Path:       "access_token",
+		Type:       "issuer",
+		StatusCode: http.StatusUnauthorized,
+	}
+	ErrTokenAudience error = &errs.Error{
+		Message:    "Token audience is not allowed",
+		Path:       "access_token",
+		Type:       "audience",
+		StatusCode: http.StatusUnauthorized,
+	}
+)
+
+func (claimStrings *ClaimStrings) UnmarshalJSON(data []byte) (err error) {
+	var value interface{}
+	if err = json.Unmarshal(data, &value); err != nil {
+		return
+	}
+	switch value := value.(type) {
+	case nil:
+		*claimStrings = nil
+	case string:
+		*claimStrings = ClaimStrings{value}
+	default:
+		var values []string
+		if err = json.Unmarshal(data, &values); err != nil {
+			return
+		}
+		*claimStrings = values
+	}
+	return
+}
+
+func (claimStrings ClaimStrings) Contains(values []string) bool {
+	for _, claimString := range claimStrings {
+		for _, value := range values {
+			if claimString == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (claims *TokenClaims) Validate(c TokenConfig, now time.Time) (err error) {
+	unix := now.Unix()
+	skew := int64(c.ClockSkew / time.Second)
+
+	// 过期
+	if claims.ExpiresAt != 0 && unix > claims.ExpiresAt+skew {
+		err = ErrTokenHasExpired
+		return
+	}
+
+	// 还未生效
+	if claims.NotBefore != 0 && unix+skew < claims.NotBefore {
+		err = ErrTokenNotValidYet
+		return
+	}
+	if claims.IssuedAt != 0 && unix+skew < claims.IssuedAt {
+		err = ErrTokenNotValidYet
+		return
+	}
+
+	if len(c.Issuers) != 0 && !(ClaimStrings{claims.Issuer}).Contains(c.Issuers) {
+		err = ErrTokenIssuer
+		return
+	}
+
+	if len(c.Audiences) != 0 && !claims.Audience.Contains(c.Audiences) {
+		err = ErrTokenAudience
+		return
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestTokenClaimsValidate(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	unix := now.Unix()
+	config := TokenConfig{
+		Issuers:   []string{"https://auth.example.com"},
+		Audiences: []string{"api", "admin"},
+		ClockSkew: time.Second * 30,
+	}
+	claims := func(data string) *TokenClaims {
+		claims := &TokenClaims{}
+		if err := json.Unmarshal([]byte(data), claims); err != nil {
+			t.Fatal(data, err)
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name   string
+		claims *TokenClaims
+		config TokenConfig
+		err    error
+	}{
+		{"empty config", &TokenClaims{}, TokenConfig{}, nil},
+		{"issuer", claims(`{"iss":"https://auth.example.com","aud":"api"}`), config, nil},
+		{"issuer mismatch", claims(`{"iss":"https://other.example.com","aud":"api"}`), config, ErrTokenIssuer},
+		{"issuer missing", claims(`{"aud":"api"}`), config, ErrTokenIssuer},
+		{"audience string", claims(`{"iss":"https://auth.example.com","aud":"admin"}`), config, nil},
+		{"audience array", claims(`{"iss":"https://auth.example.com","aud":["other","api"]}`), config, nil},
+		{"audience mismatch", claims(`{"iss":"https://auth.example.com","aud":"other"}`), config, ErrTokenAudience},
+		{"audience array mismatch", claims(`{"iss":"https://auth.example.com","aud":["other","web"]}`), config, ErrTokenAudience},
+		{"audience missing", claims(`{"iss":"https://auth.example.com"}`), config, ErrTokenAudience},
+		{"audience not checked", claims(`{"aud":"other"}`), TokenConfig{}, nil},
+
+		// 误差 边界
+		{"exp", &TokenClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: unix}}, TokenConfig{}, nil},
+		{"exp passed", &TokenClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: unix - 1}}, TokenConfig{}, ErrTokenHasExpired},
+		{"exp skew", &TokenClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: unix - 30}}, TokenConfig{ClockSkew: time.Second * 30}, nil},
+		{"exp skew passed", &TokenClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: unix - 31}}, TokenConfig{ClockSkew: time.Second * 30}, ErrTokenHasExpired},
+		{"nbf", &TokenClaims{StandardClaims: jwt.StandardClaims{NotBefore: unix}}, TokenConfig{}, nil},
+		{"nbf future", &TokenClaims{StandardClaims: jwt.StandardClaims{NotBefore: unix + 1}}, TokenConfig{}, ErrTokenNotValidYet},
+		{"nbf skew", &TokenClaims{StandardClaims: jwt.StandardClaims{NotBefore: unix + 30}}, TokenConfig{ClockSkew: time.Second * 30}, nil},
+		{"nbf skew future", &TokenClaims{StandardClaims: jwt.StandardClaims{NotBefore: unix + 31}}, TokenConfig{ClockSkew: time.Second * 30}, ErrTokenNotValidYet},
+		{"iat skew", &TokenClaims{StandardClaims: jwt.StandardClaims{IssuedAt: unix + 30}}, TokenConfig{ClockSkew: time.Second * 30}, nil},
+		{"iat skew future", &TokenClaims{StandardClaims: jwt.StandardClaims{IssuedAt: unix + 31}}, TokenConfig{ClockSkew: time.Second * 30}, ErrTokenNotValidYet},
+	}
+	for _, test := range tests {
+		if err := test.claims.Validate(test.config, now); err != test.err {
+			t.Errorf("%s: %v != %v", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,559 @@
+package model
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/otamoe/gin-server/errs"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	TokenPublicKey struct {
+		Name           string `json:"name"`
+		Hash           string `json:"hash"`
+		PublicKeyBytes []byte `json:"public_key"`
+
+		// *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey 或 HMAC []byte
+		PublicKey interface{} `json:"-"`
+
+		// JWK  RFC 7517
+		KeyID     string `json:"kid,omitempty"`
+		KeyType   string `json:"kty,omitempty"`
+		Algorithm string `json:"alg,omitempty"`
+		Use       string `json:"use,omitempty"`
+		Curve     string `json:"crv,omitempty"`
+		X         string `json:"x,omitempty"`
+		Y         string `json:"y,omitempty"`
+		N         string `json:"n,omitempty"`
+		E         string `json:"e,omitempty"`
+		K         string `json:"k,omitempty"`
+	}
+
+	TokenPublicKeys struct {
+		Time    time.Time         `json:"-"`
+		Results []*TokenPublicKey `json:"results"`
+		Keys    []*TokenPublicKey `json:"keys"`
+	}
+
+	// 公钥 更新 间隔,  0 使用 默认
+	KeysConfig struct {
+		// kid 未找到时 按需更新的 最小间隔,  0 是 30 秒
+		RefreshInterval time.Duration
+		// 计划更新 间隔,  0 是 1 小时
+		RefreshPeriod time.Duration
+		// 更新失败 重试间隔 指数增加,  0 是 1 秒 到 1 分钟
+		RetryMin time.Duration
+		RetryMax time.Duration
+	}
+
+	TokenKeysStats struct {
+		// kid 未找到
+		Unknown uint64 `json:"unknown"`
+		// 按需 更新次数
+		Refreshes uint64 `json:"refreshes"`
+		// 被限制 没有更新
+		RateLimited uint64 `json:"rate_limited"`
+		// 更新失败
+		Failures uint64 `json:"failures"`
+	}
+)
+
+type tokenKeySet struct {
+	publicKeys atomic.Value
+	stats      TokenKeysStats
+
+	refresh struct {
+		sync.Mutex
+		time time.Time
+	}
+
+	lastError struct {
+		sync.Mutex
+		err  error
+		time time.Time
+	}
+}
+
+var (
+	ErrTokenPublicKeyUnknown     = errors.New("found unknown public key type")
+	ErrTokenPublicKeyUnsupported = errors.New("unsupported JWK key type")
+
+	ErrTokenKeyNotFound error = &errs.Error{
+		Message:    "Token key not found",
+		Path:       "access_token",
+		Type:       "key_not_found",
+		StatusCode: http.StatusUnauthorized,
+	}
+
+	ErrTokenKeysNotReady error = &errs.Error{
+		Message:    "Token keys are not loaded",
+		Path:       "access_token",
+		Type:       "not_ready",
+		StatusCode: http.StatusServiceUnavailable,
+	}
+
+	ErrTokenAlgorithm error = &errs.Error{
+		Message:    "Token signing algorithm is not allowed",
+		Path:       "access_token",
+		Type:       "algorithm",
+		StatusCode: http.StatusUnauthorized,
+	}
+)
+
+func (c KeysConfig) withDefaults() KeysConfig {
+	if c.RefreshInterval <= 0 {
+		c.RefreshInterval = time.Second * 30
+	}
+	if c.RefreshPeriod <= 0 {
+		c.RefreshPeriod = time.Hour
+	}
+	if c.RetryMin <= 0 {
+		c.RetryMin = time.Second
+	}
+	if c.RetryMax < c.RetryMin {
+		c.RetryMax = time.Minute
+	}
+	return c
+}
+
+func (auth *Auth) tokenKeysURL() string {
+	options := auth.Options()
+	if options.KeysURL != "" {
+		return options.KeysURL
+	}
+	if options.AuthOrigin != "" {
+		return options.AuthOrigin + "/keys"
+	}
+	return ""
+}
+
+func (auth *Auth) requestTokenPublicKeys(ctx context.Context) (publicKeys *TokenPublicKeys, err error) {
+	keysURL := auth.tokenKeysURL()
+	if keysURL == "" {
+		err = errors.New("auth-model.AuthOrigin variable not configured")
+		return
+	}
+	var request *http.Request
+	if request, err = http.NewRequest("GET", keysURL, nil); err != nil {
+		return
+	}
+	request.Header.Set("Accept", "application/jwk-set+json, application/json")
+
+	var statusCode int
+	var bodyBytes []byte
+	if statusCode, bodyBytes, err = auth.doUpstream(ctx, upstreamKeys, request, 1<<20); err != nil {
+		return
+	}
+	logrus.Debugf("[TOKEN_KEYS] %d %s", statusCode, string(bodyBytes))
+
+	if statusCode >= http.StatusMultipleChoices {
+		err = fmt.Errorf("Token public request error status: %d", statusCode)
+		return
+	}
+	if publicKeys, err = parseTokenPublicKeys(bodyBytes); err != nil {
+		return
+	}
+	return
+}
+
+// 解析 自定义格式 {"results": [...]} 或 JWKS {"keys": [...]}
+func parseTokenPublicKeys(bodyBytes []byte) (publicKeys *TokenPublicKeys, err error) {
+	value := &TokenPublicKeys{}
+	if err = json.Unmarshal(bodyBytes, value); err != nil {
+		return
+	}
+
+	results := []*TokenPublicKey{}
+	for _, result := range value.Results {
+		if result == nil {
+			err = ErrTokenPublicKeyUnknown
+			return
+		}
+		if err = result.parse(); err != nil {
+			return
+		}
+		results = append(results, result)
+	}
+
+	// 一个 错误的 key 不影响 其他 key,  没有 可用的 key 时 才 失败
+	var keyErr error
+	for _, key := range value.Keys {
+		if key == nil {
+			continue
+		}
+		// JWKS 可能包含 其他用途 或 不支持的 key
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if e := key.parse(); e != nil {
+			if e == ErrTokenPublicKeyUnsupported {
+				logrus.Debugf("[TOKEN_KEYS] skip kid=%s kty=%s", key.KeyID, key.KeyType)
+			} else {
+				logrus.Warnf("[TOKEN_KEYS] skip kid=%s kty=%s: %s", key.KeyID, key.KeyType, e)
+				keyErr = e
+			}
+			continue
+		}
+		results = append(results, key)
+	}
+	if len(results) == 0 && keyErr != nil {
+		err = keyErr
+		return
+	}
+
+	publicKeys = &TokenPublicKeys{
+		Time:    time.Now(),
+		Results: results,
+	}
+	return
+}
+
+func (publicKey *TokenPublicKey) parse() (err error) {
+	if len(publicKey.PublicKeyBytes) != 0 {
+		var pub interface{}
+		if pub, err = x509.ParsePKIXPublicKey(publicKey.PublicKeyBytes); err != nil {
+			return
+		}
+		switch pub := pub.(type) {
+		case *ecdsa.PublicKey:
+			publicKey.PublicKey = pub
+		case *rsa.PublicKey:
+			if err = checkRSAPublicKey(pub); err != nil {
+				return
+			}
+			publicKey.PublicKey = pub
+		case ed25519.PublicKey:
+			publicKey.PublicKey = pub
+		default:
+			err = ErrTokenPublicKeyUnknown
+		}
+		return
+	}
+
+	switch publicKey.KeyType {
+	case "EC":
+		publicKey.PublicKey, err = parseJWKECDSA(publicKey.Curve, publicKey.X, publicKey.Y)
+	case "RSA":
+		publicKey.PublicKey, err = parseJWKRSA(publicKey.N, publicKey.E)
+	case "OKP":
+		publicKey.PublicKey, err = parseJWKEd25519(publicKey.Curve, publicKey.X)
+	case "oct":
+		var k []byte
+		if k, err = base64.RawURLEncoding.DecodeString(publicKey.K); err != nil {
+			return
+		}
+		if len(k) == 0 {
+			err = errors.New("JWK oct key is empty")
+			return
+		}
+		publicKey.PublicKey = k
+	case "":
+		err = ErrTokenPublicKeyUnknown
+	default:
+		err = ErrTokenPublicKeyUnsupported
+	}
+	return
+}
+
+func parseJWKECDSA(crv string, x string, y string) (publicKey *ecdsa.PublicKey, err error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		err = ErrTokenPublicKeyUnsupported
+		return
+	}
+
+	var xBytes, yBytes []byte
+	if xBytes, err = base64.RawURLEncoding.DecodeString(x); err != nil {
+		return
+	}
+	if yBytes, err = base64.RawURLEncoding.DecodeString(y); err != nil {
+		return
+	}
+	publicKey = &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xBytes),
+		Y:     new(big.Int).SetBytes(yBytes),
+	}
+	if !curve.IsOnCurve(publicKey.X, publicKey.Y) {
+		publicKey = nil
+		err = fmt.Errorf("JWK %s point is not on curve", crv)
+		return
+	}
+	return
+}
+
+func parseJWKRSA(n string, e string) (publicKey *rsa.PublicKey, err error) {
+	var nBytes, eBytes []byte
+	if nBytes, err = base64.RawURLEncoding.DecodeString(n); err != nil {
+		return
+	}
+	if eBytes, err = base64.RawURLEncoding.DecodeString(e); err != nil {
+		return
+	}
+	if len(eBytes) == 0 || len(eBytes) > 4 {
+		err = errors.New("JWK RSA exponent is invalid")
+		return
+	}
+	exponent := 0
+	for _, b := range eBytes {
+		exponent = exponent<<8 | int(b)
+	}
+	value := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: exponent,
+	}
+	if err = checkRSAPublicKey(value); err != nil {
+		return
+	}
+	publicKey = value
+	return
+}
+
+func checkRSAPublicKey(publicKey *rsa.PublicKey) (err error) {
+	if publicKey.N.BitLen() < 2048 {
+		err = fmt.Errorf("RSA public key is too small: %d bits", publicKey.N.BitLen())
+		return
+	}
+	if publicKey.E < 3 || publicKey.E%2 == 0 {
+		err = errors.New("RSA public exponent is invalid")
+		return
+	}
+	return
+}
+
+func parseJWKEd25519(crv string, x string) (publicKey ed25519.PublicKey, err error) {
+	if crv != "Ed25519" {
+		err = ErrTokenPublicKeyUnsupported
+		return
+	}
+	var xBytes []byte
+	if xBytes, err = base64.RawURLEncoding.DecodeString(x); err != nil {
+		return
+	}
+	if len(xBytes) != ed25519.PublicKeySize {
+		err = errors.New("JWK Ed25519 key size is invalid")
+		return
+	}
+	publicKey = ed25519.PublicKey(xBytes)
+	return
+}
+
+// 算法 是否 可以用这个 key 验证
+func (publicKey *TokenPublicKey) AllowAlgorithm(alg string) bool {
+	if publicKey.Algorithm != "" && publicKey.Algorithm != alg {
+		return false
+	}
+	switch key := publicKey.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		switch alg {
+		case "ES256":
+			return key.Curve == elliptic.P256()
+		case "ES384":
+			return key.Curve == elliptic.P384()
+		case "ES512":
+			return key.Curve == elliptic.P521()
+		}
+	case *rsa.PublicKey:
+		switch alg {
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+			return true
+		}
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	case []byte:
+		switch alg {
+		case "HS256", "HS384", "HS512":
+			return true
+		}
+	}
+	return false
+}
+
+func tokenKeyfunc(claims *TokenClaims, publicKeys *TokenPublicKeys) jwt.Keyfunc {
+	return func(jwtToken *jwt.Token) (interface{}, error) {
+		alg := jwtToken.Method.Alg()
+		kid, _ := jwtToken.Header["kid"].(string)
+		publicKey := publicKeys.Lookup(kid, claims.Issuer)
+		if publicKey == nil {
+			return nil, ErrTokenKeyNotFound
+		}
+		if !publicKey.AllowAlgorithm(alg) {
+			return nil, ErrTokenAlgorithm
+		}
+		return publicKey.PublicKey, nil
+	}
+}
+
+func (auth *Auth) parseTokenClaims(val string) (jwtToken *jwt.Token, claims *TokenClaims, err error) {
+	publicKeys := auth.loadTokenPublicKeys()
+	claims, jwtClaims := auth.newTokenClaims()
+	// exp nbf iat 在 TokenClaims.Validate 验证
+	parser := &jwt.Parser{ValidMethods: auth.algorithms(), SkipClaimsValidation: true}
+	jwtToken, err = parser.ParseWithClaims(val, jwtClaims, tokenKeyfunc(claims, publicKeys))
+	if !isTokenKeyNotFound(err) {
+		return
+	}
+
+	// key 不存在  可能 auth 服务器 已经轮换了 key
+	atomic.AddUint64(&auth.keys.stats.Unknown, 1)
+	refreshed := auth.refreshTokenPublicKeys(publicKeys)
+	if refreshed == nil {
+		err = ErrTokenKeysNotReady
+		return
+	}
+	if refreshed != publicKeys {
+		claims, jwtClaims = auth.newTokenClaims()
+		jwtToken, err = parser.ParseWithClaims(val, jwtClaims, tokenKeyfunc(claims, refreshed))
+	}
+	return
+}
+
+func isTokenKeyNotFound(err error) bool {
+	if validationError, ok := err.(*jwt.ValidationError); ok {
+		return validationError.Inner == ErrTokenKeyNotFound
+	}
+	return false
+}
+
+func (auth *Auth) loadTokenPublicKeys() *TokenPublicKeys {
+	publicKeys, _ := auth.keys.publicKeys.Load().(*TokenPublicKeys)
+	return publicKeys
+}
+
+// 按需 更新 公钥,  同一时间 只有一个 请求,  并且 RefreshInterval 内 最多一次
+func (auth *Auth) refreshTokenPublicKeys(old *TokenPublicKeys) (publicKeys *TokenPublicKeys) {
+	refresh := &auth.keys.refresh
+	refresh.Lock()
+	defer refresh.Unlock()
+
+	// 等待的时候 其他请求 已经更新了
+	if publicKeys = auth.loadTokenPublicKeys(); publicKeys != old {
+		return
+	}
+	if !refresh.time.IsZero() && time.Since(refresh.time) < auth.Options().Keys.withDefaults().RefreshInterval {
+		atomic.AddUint64(&auth.keys.stats.RateLimited, 1)
+		return
+	}
+	refresh.time = time.Now()
+	atomic.AddUint64(&auth.keys.stats.Refreshes, 1)
+
+	// 多个 请求 共用 结果,  不跟随 某个 请求 取消
+	val, err := auth.requestTokenPublicKeys(context.Background())
+	if err != nil {
+		atomic.AddUint64(&auth.keys.stats.Failures, 1)
+		auth.setTokenKeysLastError(err)
+		logrus.Error("[TOKEN_KEYS]", err)
+		return
+	}
+	auth.keys.publicKeys.Store(val)
+	publicKeys = val
+	return
+}
+
+func GetTokenKeysStats() TokenKeysStats {
+	return defaultAuth.GetTokenKeysStats()
+}
+
+func (auth *Auth) GetTokenKeysStats() TokenKeysStats {
+	stats := &auth.keys.stats
+	return TokenKeysStats{
+		Unknown:     atomic.LoadUint64(&stats.Unknown),
+		Refreshes:   atomic.LoadUint64(&stats.Refreshes),
+		RateLimited: atomic.LoadUint64(&stats.RateLimited),
+		Failures:    atomic.LoadUint64(&stats.Failures),
+	}
+}
+
+// 优先 JWT header kid,  没有再用 issuer 匹配 hash
+func (publicKeys *TokenPublicKeys) Lookup(kid string, issuer string) *TokenPublicKey {
+	if publicKeys == nil {
+		return nil
+	}
+	if kid != "" {
+		for _, publicKey := range publicKeys.Results {
+			if publicKey.PublicKey != nil && publicKey.KeyID == kid {
+				return publicKey
+			}
+		}
+	}
+	for _, publicKey := range publicKeys.Results {
+		if publicKey.PublicKey != nil && publicKey.Hash != "" && publicKey.Hash == issuer {
+			return publicKey
+		}
+	}
+	return nil
+}
+
+// 第一次 同步获取
+func (auth *Auth) loadTokenPublicKeysOnce(ctx context.Context) bool {
+	publicKeys, err := auth.requestTokenPublicKeys(ctx)
+	if err != nil {
+		atomic.AddUint64(&auth.keys.stats.Failures, 1)
+		auth.setTokenKeysLastError(err)
+		logrus.Error("[TOKEN_KEYS]", err)
+		return false
+	}
+	auth.keys.publicKeys.Store(publicKeys)
+	return true
+}
+
+func (auth *Auth) runTokenPublicKeys(ctx context.Context, loaded bool) {
+	c := auth.Options().Keys.withDefaults()
+	retry := c.RetryMin
+	for {
+		var wait time.Duration
+		if loaded {
+			// 计划更新 默认 每小时
+			wait = c.RefreshPeriod
+			retry = c.RetryMin
+		} else {
+			wait = retry
+			if retry *= 2; retry > c.RetryMax {
+				retry = c.RetryMax
+			}
+		}
+		if !sleepContext(ctx, wait) {
+			return
+		}
+		loaded = auth.loadTokenPublicKeysOnce(ctx)
+	}
+}
+
+func (auth *Auth) setTokenKeysLastError(err error) {
+	lastError := &auth.keys.lastError
+	lastError.Lock()
+	lastError.err = err
+	lastError.time = time.Now()
+	lastError.Unlock()
+}
+
+func (auth *Auth) tokenKeysLastError() (err error, errAt time.Time) {
+	lastError := &auth.keys.lastError
+	lastError.Lock()
+	err = lastError.err
+	errAt = lastError.time
+	lastError.Unlock()
+	return
+}
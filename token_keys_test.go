@@ -0,0 +1,306 @@
+package model
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestParseTokenPublicKeysJWKS(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "EC",
+				"kid": "key-1",
+				"use": "sig",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(privateKey.X.Bytes()),
+				"y":   base64.RawURLEncoding.EncodeToString(privateKey.Y.Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "key-enc",
+				"use": "enc",
+			},
+			{
+				"kty": "unknown",
+				"kid": "key-unknown",
+			},
+		},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+	auth := NewAuth(Options{KeysURL: server.URL})
+
+	publicKeys, err := auth.requestTokenPublicKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(publicKeys.Results) != 1 {
+		t.Fatal("Results", len(publicKeys.Results))
+	}
+	publicKey := publicKeys.Lookup("key-1", "")
+	if publicKey == nil {
+		t.Fatal("Lookup key-1 not found")
+	}
+	if ecdsaPublicKey, ok := publicKey.PublicKey.(*ecdsa.PublicKey); !ok || ecdsaPublicKey.X.Cmp(privateKey.X) != 0 || ecdsaPublicKey.Y.Cmp(privateKey.Y) != 0 {
+		t.Fatal("Lookup key-1 mismatch")
+	}
+	if publicKeys.Lookup("key-enc", "") != nil {
+		t.Fatal("Lookup key-enc found")
+	}
+}
+
+// 错误的 key 跳过,  全部 错误 才 失败
+func TestParseTokenPublicKeysInvalid(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := []map[string]string{
+		{
+			"kty": "RSA",
+			"kid": "rsa-1024",
+			"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		{
+			"kty": "EC",
+			"kid": "not-on-curve",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString([]byte{1}),
+			"y":   base64.RawURLEncoding.EncodeToString([]byte{1}),
+		},
+		{
+			"kty": "OKP",
+			"kid": "bad-base64",
+			"crv": "Ed25519",
+			"x":   "!!!",
+		},
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"keys": append(invalid, map[string]string{
+			"kty": "EC",
+			"kid": "key-1",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(privateKey.X.Bytes()),
+			"y":   base64.RawURLEncoding.EncodeToString(privateKey.Y.Bytes()),
+		}),
+	})
+	publicKeys, err := parseTokenPublicKeys(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(publicKeys.Results) != 1 || publicKeys.Lookup("key-1", "") == nil {
+		t.Fatal("Results", len(publicKeys.Results))
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{"keys": invalid})
+	if _, err = parseTokenPublicKeys(body); err == nil {
+		t.Fatal("invalid")
+	}
+}
+
+func TestParseTokenPublicKeysResults(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"results": []map[string]interface{}{
+			{
+				"name":       "token",
+				"hash":       "hash-1",
+				"public_key": publicKeyBytes,
+			},
+		},
+	})
+
+	publicKeys, err := parseTokenPublicKeys(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publicKeys.Lookup("other", "hash-1") == nil {
+		t.Fatal("Lookup hash-1 not found")
+	}
+	if publicKeys.Lookup("", "hash-2") != nil {
+		t.Fatal("Lookup hash-2 found")
+	}
+}
+
+func TestTokenKeyfuncAlgorithm(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+	body, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "OKP",
+				"kid": "ed",
+				"crv": "Ed25519",
+				"x":   base64.RawURLEncoding.EncodeToString(publicKey),
+			},
+			{
+				"kty": "oct",
+				"kid": "hs",
+				"k":   base64.RawURLEncoding.EncodeToString(secret),
+			},
+		},
+	})
+	publicKeys, err := parseTokenPublicKeys(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		jwtToken := jwt.NewWithClaims(method, &TokenClaims{Name: "token"})
+		jwtToken.Header["kid"] = kid
+		val, err := jwtToken.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return val
+	}
+	parse := func(val string, algorithms []string) error {
+		claims := &TokenClaims{}
+		_, err := (&jwt.Parser{ValidMethods: algorithms}).ParseWithClaims(val, claims, tokenKeyfunc(claims, publicKeys))
+		return err
+	}
+
+	if err = parse(sign(SigningMethodEd25519, "ed", privateKey), Algorithms); err != nil {
+		t.Fatal("EdDSA", err)
+	}
+	if err = parse(sign(jwt.SigningMethodHS256, "hs", secret), Algorithms); err == nil {
+		t.Fatal("HS256 is not allowed by default")
+	}
+	if err = parse(sign(jwt.SigningMethodHS256, "hs", secret), []string{"HS256"}); err != nil {
+		t.Fatal("HS256", err)
+	}
+	// key 类型 不匹配
+	if err = parse(sign(jwt.SigningMethodHS256, "ed", []byte(publicKey)), []string{"HS256"}); err == nil {
+		t.Fatal("HS256 with Ed25519 key")
+	}
+}
+
+func TestParseTokenClaimsRefresh(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := json.Marshal(map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kty": "OKP",
+					"kid": "rotated",
+					"crv": "Ed25519",
+					"x":   base64.RawURLEncoding.EncodeToString(publicKey),
+				},
+			},
+		})
+		w.Write(body)
+	}))
+	defer server.Close()
+	auth := NewAuth(Options{KeysURL: server.URL})
+	auth.keys.publicKeys.Store(&TokenPublicKeys{})
+
+	jwtToken := jwt.NewWithClaims(SigningMethodEd25519, &TokenClaims{Name: "token"})
+	jwtToken.Header["kid"] = "rotated"
+	val, err := jwtToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = auth.parseTokenClaims(val); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Fatal("requests", requests)
+	}
+
+	jwtToken.Header["kid"] = "unknown"
+	if val, err = jwtToken.SignedString(privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = auth.parseTokenClaims(val); err == nil {
+		t.Fatal("unknown kid")
+	}
+	if requests != 1 {
+		t.Fatal("rate limited requests", requests)
+	}
+	if stats := auth.GetTokenKeysStats(); stats.RateLimited != 1 || stats.Refreshes != 1 {
+		t.Fatal("stats", stats)
+	}
+}
+
+func TestStartRetry(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer server.Close()
+	auth := NewAuth(Options{
+		KeysURL: server.URL,
+		Keys:    KeysConfig{RetryMin: time.Millisecond * 10},
+		// 只测试 Start 的 重试
+		Retry: RetryConfig{Attempts: 1},
+	})
+
+	handle := auth.Start()
+	if auth.Start() != handle {
+		t.Fatal("Start twice")
+	}
+	if status := handle.Status(); status.Ready || status.LastError == "" {
+		t.Fatal("Status", status)
+	}
+	for i := 0; i < 100 && !handle.Status().Ready; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !handle.Status().Ready {
+		t.Fatal("Status not ready")
+	}
+	handle.Stop()
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatal("requests", n)
+	}
+	restarted := auth.Start()
+	restarted.Stop()
+	if restarted == handle {
+		t.Fatal("Start after Stop")
+	}
+}
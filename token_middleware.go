@@ -2,20 +2,13 @@ package model
 
 import (
 	"context"
-	"crypto/ecdsa"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
-	"sort"
 	"strings"
-	"sync/atomic"
 	"time"
 
-	"github.com/globalsign/mgo"
 	"github.com/otamoe/gin-server/errs"
 	ginLogger "github.com/otamoe/gin-server/logger"
 	"github.com/sirupsen/logrus"
@@ -31,6 +24,39 @@ type (
 		Required bool
 		Expired  bool
 		Cache    bool
+
+		// 为空 不验证
+		Audiences []string
+		Issuers   []string
+
+		// 时钟误差  exp nbf iat 和 Token.ExpiredAt
+		ClockSkew time.Duration
+
+		// VerifierJWT 默认,  VerifierIntrospection,  VerifierAuto
+		Verifier string
+
+		// 读取 token 的顺序, 默认 只有 TokenSourceHeader,  TokenSourceQuery 需要明确开启
+		Sources []string
+		// 默认 access_token
+		CookieName string
+
+		// DPoP  RFC 9449,  开启后 绑定的 token 必须有 DPoP proof
+		DPoP bool
+		// 不接受 Bearer token
+		DPoPRequired bool
+		// 需要 服务器 nonce
+		DPoPNonce bool
+		// htu 使用 X-Forwarded-Proto X-Forwarded-Host,  只在 反向代理 覆盖 客户端传入的 同名 header 时 开启
+		DPoPTrustForwarded bool
+
+		// token 必须 绑定 客户端证书  RFC 8705
+		CertificateBound bool
+		// 反向代理 转发 客户端证书的 header,  代理 必须 删除 客户端传入的同名 header
+		CertificateHeader string
+
+		// 缓存的 token 用户 超过 UserMaxAge 后台刷新,  超过 UserHardMaxAge 同步 重新获取,  0 不限制
+		UserMaxAge     time.Duration
+		UserHardMaxAge time.Duration
 	}
 	TokenClaims struct {
 		Name     string        `json:"name"`
@@ -39,19 +65,11 @@ type (
 		Scope    string        `json:"scope"`
 		Username string        `json:"username"`
 		Nickname string        `json:"nickname"`
-		jwt.StandardClaims
-	}
 
-	TokenPublicKey struct {
-		Name           string           `json:"name"`
-		Hash           string           `json:"hash"`
-		PublicKeyBytes []byte           `json:"public_key"`
-		PublicKey      *ecdsa.PublicKey `json:"-"`
-	}
-
-	TokenPublicKeys struct {
-		Time    time.Time         `json:"-"`
-		Results []*TokenPublicKey `json:"results"`
+		// aud 可以是 字符串 或 数组
+		Audience     ClaimStrings       `json:"aud,omitempty"`
+		Confirmation *TokenConfirmation `json:"cnf,omitempty"`
+		jwt.StandardClaims
 	}
 
 	Errors struct {
@@ -60,9 +78,11 @@ type (
 	}
 )
 
-var tokenPublicKeys atomic.Value
-
 func TokenMiddleware(c TokenConfig) gin.HandlerFunc {
+	return defaultAuth.TokenMiddleware(c)
+}
+
+func (auth *Auth) TokenMiddleware(c TokenConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		var err error
 		var token *Token
@@ -70,122 +90,83 @@ func TokenMiddleware(c TokenConfig) gin.HandlerFunc {
 			if err == nil && c.Required && token == nil {
 				err = ErrTokenNotFound
 			}
+			auth.metrics.tokenResult(token, err)
 			if err != nil {
-				switch err.(type) {
-				case *errs.Error:
-					err2 := err.(*errs.Error).Clone()
-					err2.StatusCode = http.StatusUnauthorized
-					err = err2
+				if c.DPoP {
+					auth.Options().DPoP.withDefaults().challenge(ctx.Writer.Header())
 				}
-				ctx.Error(err)
+				ctx.Error(unauthorizedError(err))
 				ctx.Abort()
 			} else {
 				ctx.Next()
 			}
 		}()
 
-		vary := ctx.Writer.Header().Get("Vary")
-		if vary == "" {
-			vary = "Authorization"
-		} else {
-			vary += ", Authorization"
-		}
-		ctx.Header("Vary", vary)
-
-		auth := ctx.GetHeader("Authorization")
+		c.setVary(ctx.Writer.Header())
 
-		// header
-		if len(auth) > 7 && strings.ToLower(auth[:7]) == "bearer " {
-			token, err = GetToken(ctx, c.Types, strings.TrimSpace(auth[7:]), c.Expired, c.Cache)
+		val, _ := c.readToken(ctx.Request)
+		stripLoggerQueryToken(ctx)
+		if val != "" {
+			token, err = auth.GetTokenWithConfig(ctx, c, val)
 		}
 
 		return
 	}
 }
 
-func requestTokenPublicKeys() (publicKeys *TokenPublicKeys, err error) {
-	if AuthOrigin == "" {
-		err = errors.New("auth-model.AuthOrigin variable not configured")
-		return
-	}
-	var request *http.Request
-	var response *http.Response
-
-	timeoutContext, timeoutCancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer timeoutCancel()
-	client := &http.Client{}
-	if request, err = http.NewRequest("GET", AuthOrigin+"/keys", nil); err != nil {
-		return
-	}
-	request = request.WithContext(timeoutContext)
-	if response, err = client.Do(request); err != nil {
-		return
+func (c TokenConfig) setVary(header http.Header) {
+	varys := []string{"Authorization"}
+	for _, source := range c.sources() {
+		if source == TokenSourceCookie {
+			varys = append(varys, "Cookie")
+		}
 	}
-	defer response.Body.Close()
-	var bodyBytes []byte
-	if bodyBytes, err = ioutil.ReadAll(io.LimitReader(response.Body, 1<<20)); err != nil {
-		return
+	if c.DPoP {
+		varys = append(varys, "DPoP")
 	}
-	logrus.Debugf("[TOKEN_KEYS] %d %s", response.StatusCode, string(bodyBytes))
-
-	if response.StatusCode >= http.StatusMultipleChoices {
-		err = fmt.Errorf("Token public request error status: %d", response.StatusCode)
-	}
-	publicKeys = &TokenPublicKeys{}
-	if err = json.Unmarshal(bodyBytes, publicKeys); err != nil {
-		return
+	vary := header.Get("Vary")
+	if vary == "" {
+		vary = strings.Join(varys, ", ")
+	} else {
+		vary += ", " + strings.Join(varys, ", ")
 	}
+	header.Set("Vary", vary)
+}
 
-	for _, result := range publicKeys.Results {
-		if result == nil {
-			err = errors.New("found unknown public key type in ECDSA wrapping")
-			return
-		}
-		var pub interface{}
-		if pub, err = x509.ParsePKIXPublicKey(result.PublicKeyBytes); err != nil {
-			return
-		}
-		switch pub.(type) {
-		case *ecdsa.PublicKey:
-			result.PublicKey = pub.(*ecdsa.PublicKey)
-		default:
-			err = errors.New("found unknown public key type in ECDSA wrapping")
-			return
+// 客户端错误 都是 401,  服务器错误 保留
+func unauthorizedError(err error) error {
+	switch err.(type) {
+	case *errs.Error:
+		err2 := err.(*errs.Error).Clone()
+		if err2.StatusCode < http.StatusInternalServerError {
+			err2.StatusCode = http.StatusUnauthorized
 		}
+		err = err2
 	}
-	publicKeys.Time = time.Now()
-	return
+	return err
 }
 
-func requestToken(auth string) (token *Token, err error) {
-	if UserOrigin == "" {
+func (auth *Auth) requestToken(ctx context.Context, val string) (token *Token, err error) {
+	userOrigin := auth.Options().UserOrigin
+	if userOrigin == "" {
 		err = errors.New("auth-model.UserOrigin variable not configured")
 		return
 	}
 	var request *http.Request
-	var response *http.Response
-
-	timeoutContext, timeoutCancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer timeoutCancel()
-	client := &http.Client{}
-	if request, err = http.NewRequest("GET", UserOrigin+"/me/token/me/", nil); err != nil {
+	if request, err = http.NewRequest("GET", userOrigin+"/me/token/me/", nil); err != nil {
 		return
 	}
-	request = request.WithContext(timeoutContext)
+	request.Header.Add("Authorization", "Bearer "+val)
 
-	request.Header.Add("Authorization", "Bearer "+auth)
-	if response, err = client.Do(request); err != nil {
-		return
-	}
-	defer response.Body.Close()
+	var statusCode int
 	var bodyBytes []byte
-	if bodyBytes, err = ioutil.ReadAll(io.LimitReader(response.Body, 1<<20)); err != nil {
+	if statusCode, bodyBytes, err = auth.doUpstream(ctx, upstreamToken, request, 1<<20); err != nil {
 		return
 	}
 
-	logrus.Debugf("[TOKEN] %d %s", response.StatusCode, string(bodyBytes))
+	logrus.Debugf("[TOKEN] %d %s", statusCode, string(bodyBytes))
 
-	if response.StatusCode >= http.StatusMultipleChoices {
+	if statusCode >= http.StatusMultipleChoices {
 		tokenErrors := &Errors{}
 		if err = json.Unmarshal(bodyBytes, tokenErrors); err != nil {
 			return
@@ -194,9 +175,12 @@ func requestToken(auth string) (token *Token, err error) {
 		for _, val := range tokenErrors.Errors {
 			message = append(message, val.Message)
 		}
+		if tokenErrors.StatusCode != 0 {
+			statusCode = tokenErrors.StatusCode
+		}
 		err = &errs.Error{
 			Message:    strings.Join(message, ", "),
-			StatusCode: tokenErrors.StatusCode,
+			StatusCode: statusCode,
 		}
 		return
 	}
@@ -208,29 +192,45 @@ func requestToken(auth string) (token *Token, err error) {
 }
 
 func GetToken(ctx *gin.Context, types []string, val string, expired bool, cache bool) (token *Token, err error) {
-	key := CONTEXT_TOKEN
+	return defaultAuth.GetTokenWithConfig(ctx, TokenConfig{Types: types, Expired: expired, Cache: cache}, val)
+}
+
+func GetTokenWithConfig(ctx *gin.Context, c TokenConfig, val string) (token *Token, err error) {
+	return defaultAuth.GetTokenWithConfig(ctx, c, val)
+}
 
-	if value, ok := ctx.Get(key); ok {
-		token = value.(*Token)
+func (auth *Auth) GetTokenWithConfig(ctx *gin.Context, c TokenConfig, val string) (token *Token, err error) {
+	var current *Token
+	if value, ok := ctx.Get(CONTEXT_TOKEN); ok {
+		current = value.(*Token)
 	}
+	if token, err = auth.verifyToken(ctx, c, ctx.Request, ctx.Writer.Header(), current, val); err != nil {
+		return
+	}
+	if token != current {
+		setContextToken(ctx, token)
+	}
+	return
+}
 
-	claims := &TokenClaims{}
+func (auth *Auth) getJWTToken(ctx context.Context, c TokenConfig, current *Token, val string) (token *Token, claims *TokenClaims, err error) {
+	token = current
 	var jwtToken *jwt.Token
-	jwtToken, err = jwt.ParseWithClaims(val, claims, func(token *jwt.Token) (interface{}, error) {
-		publicKeys := tokenPublicKeys.Load().(*TokenPublicKeys)
-		for _, publicKey := range publicKeys.Results {
-			if publicKey.Hash != "" && publicKey.PublicKey != nil && publicKey.Hash == claims.Issuer {
-				return publicKey.PublicKey, nil
-			}
-		}
-		return nil, ErrTokenNotFound
-	})
+	_, span := auth.startSpan(ctx, "auth.ParseToken")
+	jwtToken, claims, err = auth.parseTokenClaims(val)
+	endSpan(span, err)
 
+	if err == ErrTokenKeysNotReady {
+		return
+	}
 	if err != nil {
 		err = &errs.Error{
 			Err:        err,
 			StatusCode: http.StatusForbidden,
 		}
+		if isTokenSignatureError(err) {
+			auth.negativeCacheSet(val, err)
+		}
 		return
 	}
 
@@ -239,111 +239,111 @@ func GetToken(ctx *gin.Context, types []string, val string, expired bool, cache
 		return
 	}
 
+	if err = claims.Validate(c, time.Now()); err != nil {
+		return
+	}
+
 	if token == nil {
 		id := claims.Subject
 		// token 写入
 		token = &Token{}
-		if cache {
-			if err = ModelToken.Query(ctx).ID(id).PopulatePath("User", ModelUser.Query(ctx)).One(token); err != nil {
-				if err != mgo.ErrNotFound {
+		if c.Cache && bson.IsObjectIdHex(id) {
+			if cached, ok := auth.cacheGetToken(id); ok {
+				token = cached
+			} else if stored, e := auth.findToken(ctx, bson.ObjectIdHex(id)); e != nil {
+				if e != ErrNotFound {
+					err = e
 					return
 				}
-			}
-		}
-		if !token.ID.Valid() {
-			if token, err = requestToken(val); err != nil {
-				return
-			}
-			if token.User == nil {
-				err = ErrUserNotFound
-				return
-			}
-			token.New(ctx, ModelToken, token, true)
-			if err = token.Save(); err != nil && !mgo.IsDup(err) {
+			} else if stored.Issuer != auth.Options().Issuer {
+				// 其他 issuer 的 token
+				err = ErrTokenNotFound
 				return
+			} else {
+				token = stored
+				auth.cacheSetToken(token)
+				auth.metrics.storeLookup(ModelToken.Name, "hit")
 			}
-
-			// 用户字段
-			user := &User{}
-			if err = ModelUser.Query(ctx).ID(token.UserID).One(user); err != nil {
-				if err != mgo.ErrNotFound {
+			if token.ID.Valid() && token.User != nil {
+				if err = auth.refreshTokenUser(ctx, c, token); err != nil {
 					return
 				}
-				// 创建
-				user = token.User
-				user.New(ctx, ModelUser, user, true)
-			} else {
-
-				user.New(ctx, ModelUser, user, false)
-				//  更新
-				user.Username = token.User.Username
-				user.Nickname = token.User.Nickname
-				user.Avatar = token.User.Avatar
-				user.Locale = token.User.Locale
-				user.Description = token.User.Description
-				user.Gender = token.User.Gender
-				user.Birthday = token.User.Birthday
-				user.CreatedAt = token.User.CreatedAt
-				user.UpdatedAt = token.User.UpdatedAt
-				token.User = user
 			}
-
-			// 更新用户
-			if err = user.Save(); err != nil && !mgo.IsDup(err) {
+		}
+		if !token.ID.Valid() {
+			// 同一个 token 并发 只请求一次,  和 userFlight 一样 按 Cache 区分
+			var value interface{}
+			if value, err, _ = auth.tokenFlight.DoContext(ctx, fmt.Sprintf("%s:%t", negativeCacheKey(val), c.Cache), func() (interface{}, error) {
+				auth.metrics.storeLookup(ModelToken.Name, "fetch")
+				return auth.fetchToken(ctx, c, val)
+			}); err != nil {
 				return
 			}
-			err = nil
+			token = value.(*Token).clone()
 		}
 
 		if token.User == nil {
 			err = ErrUserNotFound
+			auth.negativeCacheSet(val, err)
 			return
 		}
-
-		logger := ctx.MustGet(ginLogger.CONTEXT).(*ginLogger.Logger)
-		logger.TokenID = token.ID
-		logger.UserID = token.UserID
-		ctx.Set(key, token)
 	}
 
 	if token.ID.Hex() != claims.Subject || token.Type != claims.Type || token.UserID.Hex() != claims.UserID.Hex() {
 		err = ErrTokenNotFound
 		return
 	}
+	return
+}
 
-	if len(types) != 0 {
-		sort.Strings(types)
-		if i := sort.SearchStrings(types, token.Type); i == len(types) || types[i] != token.Type {
-			err = ErrTokenNotFound
-			return
+func (auth *Auth) fetchToken(ctx context.Context, c TokenConfig, val string) (token *Token, err error) {
+	if token, err = auth.requestToken(ctx, val); err != nil {
+		if isUpstreamRejection(err) {
+			auth.negativeCacheSet(val, err)
 		}
+		return
 	}
-
-	if expired && token.ExpiredAt.Before(time.Now()) {
-		err = ErrTokenHasExpired
+	if token.User == nil {
+		err = ErrUserNotFound
+		auth.negativeCacheSet(val, err)
+		return
+	}
+	token.Issuer = auth.Options().Issuer
+	if err = auth.tokenStore().InsertToken(ctx, token); err != nil {
 		return
 	}
 
+	// 更新用户
+	var user *User
+	if user, err = auth.userStore().UpsertUser(ctx, token.User); err != nil {
+		return
+	}
+	token.User = user
+	auth.cacheSetUser(user)
+	if c.Cache {
+		auth.cacheSetToken(token)
+	}
 	return
 }
 
-func initTokenPublicKeys() {
-	var err error
-	var publicKeys *TokenPublicKeys
-	if publicKeys, err = requestTokenPublicKeys(); err != nil {
-		panic(err)
-	}
-	tokenPublicKeys.Store(publicKeys)
-	go func() {
-		for {
-			// 计划更新 每小时
-			val, err := requestTokenPublicKeys()
-			if err == nil {
-				tokenPublicKeys.Store(val)
-			} else {
-				logrus.Error("[TOKEN_KEYS]", err)
-			}
-			time.Sleep(time.Hour)
+func (auth *Auth) refreshTokenUser(ctx context.Context, c TokenConfig, token *Token) (err error) {
+	switch token.User.staleness(c.UserMaxAge, c.UserHardMaxAge, time.Now()) {
+	case userStale:
+		auth.refreshUserBackground(ctx, token.UserID.Hex())
+	case userExpired:
+		var user *User
+		if user, err = auth.refreshUser(ctx, token.UserID.Hex()); err != nil {
+			return
 		}
-	}()
+		token.User = user
+		auth.cacheSetToken(token)
+	}
+	return
+}
+
+func setContextToken(ctx *gin.Context, token *Token) {
+	logger := ctx.MustGet(ginLogger.CONTEXT).(*ginLogger.Logger)
+	logger.TokenID = token.ID
+	logger.UserID = token.UserID
+	ctx.Set(CONTEXT_TOKEN, token)
 }
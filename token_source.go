@@ -0,0 +1,92 @@
+package model
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	ginLogger "github.com/otamoe/gin-server/logger"
+)
+
+// RFC 6750
+const (
+	TokenSourceHeader = "header"
+	TokenSourceCookie = "cookie"
+	TokenSourceQuery  = "query"
+	TokenSourceForm   = "form"
+
+	TokenParam = "access_token"
+)
+
+func (c TokenConfig) sources() []string {
+	if len(c.Sources) == 0 {
+		return []string{TokenSourceHeader}
+	}
+	return c.Sources
+}
+
+func (c TokenConfig) cookieName() string {
+	if c.CookieName == "" {
+		return TokenParam
+	}
+	return c.CookieName
+}
+
+// 按 Sources 顺序 读取,  第一个找到的.  query 里的 token 不管 是否 使用 都会从 URL 删除
+func (c TokenConfig) readToken(request *http.Request) (val string, source string) {
+	queryToken := stripQueryToken(request)
+	for _, source = range c.sources() {
+		switch source {
+		case TokenSourceHeader:
+			auth := request.Header.Get("Authorization")
+			if len(auth) > 7 && strings.ToLower(auth[:7]) == "bearer " {
+				val = strings.TrimSpace(auth[7:])
+			} else if c.DPoP && len(auth) > 5 && strings.ToLower(auth[:5]) == "dpop " {
+				val = strings.TrimSpace(auth[5:])
+			}
+		case TokenSourceCookie:
+			// PathUnescape 不会 把 base64 的 + 变成 空格
+			if cookie, err := request.Cookie(c.cookieName()); err == nil {
+				if val, err = url.PathUnescape(cookie.Value); err != nil {
+					val = cookie.Value
+				}
+			}
+		case TokenSourceQuery:
+			val = queryToken
+		case TokenSourceForm:
+			contentType := strings.TrimSpace(strings.Split(request.Header.Get("Content-Type"), ";")[0])
+			if request.Method != "GET" && contentType == "application/x-www-form-urlencoded" {
+				val = request.PostFormValue(TokenParam)
+			}
+		}
+		if val = strings.TrimSpace(val); val != "" {
+			return
+		}
+	}
+	source = ""
+	return
+}
+
+func stripQueryToken(request *http.Request) (val string) {
+	if request.URL == nil || !strings.Contains(request.URL.RawQuery, TokenParam) {
+		return
+	}
+	query := request.URL.Query()
+	if _, ok := query[TokenParam]; !ok {
+		return
+	}
+	val = query.Get(TokenParam)
+	query.Del(TokenParam)
+	request.URL.RawQuery = query.Encode()
+	return
+}
+
+// 请求日志 不记录 token
+func stripLoggerQueryToken(ctx *gin.Context) {
+	if value, ok := ctx.Get(ginLogger.CONTEXT); ok {
+		if logger, ok := value.(*ginLogger.Logger); ok && logger.Query != nil {
+			logger.Query.Del(TokenParam)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	ginLogger "github.com/otamoe/gin-server/logger"
+)
+
+func TestReadToken(t *testing.T) {
+	all := []string{TokenSourceHeader, TokenSourceCookie, TokenSourceQuery, TokenSourceForm}
+	newRequest := func(header, cookie, query, form bool) *http.Request {
+		target := "/path?a=1"
+		if query {
+			target += "&access_token=query"
+		}
+		var request *http.Request
+		if form {
+			request = httptest.NewRequest("POST", target, strings.NewReader("access_token=form"))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+		} else {
+			request = httptest.NewRequest("GET", target, nil)
+		}
+		if header {
+			request.Header.Set("Authorization", "Bearer header")
+		}
+		if cookie {
+			request.AddCookie(&http.Cookie{Name: "session", Value: "cookie"})
+		}
+		return request
+	}
+
+	tests := []struct {
+		name    string
+		sources []string
+		request *http.Request
+		val     string
+		source  string
+	}{
+		{"default header", nil, newRequest(true, true, true, true), "header", TokenSourceHeader},
+		{"default ignores query", nil, newRequest(false, true, true, true), "", ""},
+		{"header first", all, newRequest(true, true, true, true), "header", TokenSourceHeader},
+		{"cookie", all, newRequest(false, true, true, true), "cookie", TokenSourceCookie},
+		{"query", all, newRequest(false, false, true, true), "query", TokenSourceQuery},
+		{"form", all, newRequest(false, false, false, true), "form", TokenSourceForm},
+		{"order", []string{TokenSourceForm, TokenSourceQuery, TokenSourceHeader}, newRequest(true, false, true, true), "form", TokenSourceForm},
+		{"none", all, newRequest(false, false, false, false), "", ""},
+	}
+	for _, test := range tests {
+		c := TokenConfig{Sources: test.sources, CookieName: "session"}
+		val, source := c.readToken(test.request)
+		if val != test.val || source != test.source {
+			t.Errorf("%s: %s %s", test.name, val, source)
+		}
+		// 不管 是否 使用 都从 URL 删除
+		if query := test.request.URL.Query(); query.Get("access_token") != "" || query.Get("a") != "1" {
+			t.Errorf("%s: query %s", test.name, test.request.URL.RawQuery)
+		}
+	}
+
+	// base64 的 + 不变成 空格
+	request := httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(&http.Cookie{Name: "access_token", Value: "a+b/c%3D"})
+	if val, _ := (TokenConfig{Sources: all}).readToken(request); val != "a+b/c=" {
+		t.Fatal("cookie", val)
+	}
+}
+
+func TestTokenMiddlewareStripQuery(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	ctx, engine := gin.CreateTestContext(recorder)
+	logger := &ginLogger.Logger{}
+	engine.Use(func(ctx *gin.Context) {
+		logger.Query = ctx.Request.URL.Query()
+		ctx.Set(ginLogger.CONTEXT, logger)
+	}, NewAuth(Options{}).TokenMiddleware(TokenConfig{}))
+	engine.GET("/", func(ctx *gin.Context) {})
+	ctx.Request = httptest.NewRequest("GET", "/?access_token=secret&a=1", nil)
+	engine.HandleContext(ctx)
+
+	// 默认 Sources 不读取 query,  日志 也 不记录
+	if _, ok := logger.Query["access_token"]; ok || logger.Query.Get("a") != "1" {
+		t.Fatal("logger query", logger.Query)
+	}
+}
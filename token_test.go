@@ -0,0 +1,91 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestTokenIndexs(t *testing.T) {
+	expireAfter := func() time.Duration {
+		for _, index := range ModelToken.Indexs {
+			if len(index.Key) == 1 && index.Key[0] == "expired_at" {
+				return index.ExpireAfter
+			}
+		}
+		t.Fatal("expired_at index")
+		return 0
+	}
+	// 默认 不开启 TTL
+	if d := expireAfter(); d != 0 {
+		t.Fatal("default", d)
+	}
+
+	grace, indexs := TokenExpireGrace, ModelToken.Indexs
+	defer func() {
+		TokenExpireGrace, ModelToken.Indexs = grace, indexs
+	}()
+	ConfigTokenExpiry(time.Minute*10, true)
+	if d := expireAfter(); d != time.Minute*10 || TokenExpireGrace != time.Minute*10 {
+		t.Fatal("ttl", d)
+	}
+	// 0 是 默认 1 小时
+	ConfigTokenExpiry(0, true)
+	if d := expireAfter(); d != time.Hour {
+		t.Fatal("default ttl", d)
+	}
+	// TTL 索引 最少 1 秒
+	ConfigTokenExpiry(-1, true)
+	if d := expireAfter(); d != time.Second {
+		t.Fatal("min", d)
+	}
+	ConfigTokenExpiry(time.Minute, false)
+	if d := expireAfter(); d != 0 || len(ModelToken.Indexs) != 3 {
+		t.Fatal("sweeper", d)
+	}
+}
+
+func TestPurgeExpiredTokens(t *testing.T) {
+	store := NewMemoryStore()
+	auth := NewAuth(Options{TokenStore: store, UserStore: store})
+	ctx := context.Background()
+	now := time.Now()
+	insert := func(expiredAt time.Time) bson.ObjectId {
+		token := &Token{ID: bson.NewObjectId(), ExpiredAt: &expiredAt}
+		if err := store.InsertToken(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+		return token.ID
+	}
+	// 过期 超过 TokenExpireGrace
+	expired := insert(now.Add(-TokenExpireGrace - time.Minute))
+	grace := insert(now.Add(-TokenExpireGrace + time.Minute))
+	valid := insert(now.Add(time.Hour))
+
+	if n, err := auth.PurgeExpiredTokens(ctx); err != nil || n != 1 {
+		t.Fatal("PurgeExpiredTokens", n, err)
+	}
+	if _, err := store.FindToken(ctx, expired); err != ErrNotFound {
+		t.Fatal("expired", err)
+	}
+	for _, id := range []bson.ObjectId{grace, valid} {
+		if _, err := store.FindToken(ctx, id); err != nil {
+			t.Fatal(id, err)
+		}
+	}
+
+	// 后台 定时 删除
+	expired = insert(now.Add(-TokenExpireGrace - time.Minute))
+	handle := auth.Start()
+	defer handle.Stop()
+	handle.SweepTokens(nil, time.Millisecond*10)
+	for i := 0; i < 100; i++ {
+		if _, err := store.FindToken(ctx, expired); err == ErrNotFound {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("SweepTokens")
+}
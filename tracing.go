@@ -0,0 +1,88 @@
+package model
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/otamoe/auth-model"
+
+// startSpan 包装 gin.Context 后 保存 原来的 gin.Context,  upstreamContext 使用
+type ginContextKey struct{}
+
+func (auth *Auth) tracerProvider() trace.TracerProvider {
+	if provider := auth.Options().TracerProvider; provider != nil {
+		return provider
+	}
+	return otel.GetTracerProvider()
+}
+
+// 默认 W3C traceparent
+func (auth *Auth) propagator() propagation.TextMapPropagator {
+	if propagator := auth.Options().Propagator; propagator != nil {
+		return propagator
+	}
+	return propagation.TraceContext{}
+}
+
+func (auth *Auth) startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return startSpanWithTracer(auth.tracerProvider().Tracer(tracerName), ctx, name, trace.WithAttributes(attributes...))
+}
+
+// 没有 Auth 的 地方 (Store) 使用 上层 span 的 TracerProvider
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(upstreamContext(ctx)).TracerProvider().Tracer(tracerName)
+	return startSpanWithTracer(tracer, ctx, name, trace.WithAttributes(attributes...))
+}
+
+// 父 span 从 请求的 context 读取,  返回的 context 仍然 可以 读取 gin.Context 的 Keys (mongo session)
+func startSpanWithTracer(tracer trace.Tracer, ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	_, span := tracer.Start(upstreamContext(ctx), name, options...)
+	if ginContext, ok := ctx.(*gin.Context); ok {
+		ctx = context.WithValue(ginContext, ginContextKey{}, ginContext)
+	}
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != ErrNotFound {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, errorType(err))
+	}
+	span.End()
+}
+
+// 不包括 token 字符串
+func tokenAttributes(token *Token) []attribute.KeyValue {
+	attributes := []attribute.KeyValue{
+		attribute.String("auth.token.type", token.Type),
+	}
+	if token.ApplicationID.Valid() {
+		attributes = append(attributes, attribute.String("auth.application", token.ApplicationID.Hex()))
+	}
+	if token.Issuer != "" {
+		attributes = append(attributes, attribute.String("auth.token.issuer", token.Issuer))
+	}
+	return attributes
+}
+
+func (auth *Auth) findToken(ctx context.Context, id bson.ObjectId) (token *Token, err error) {
+	ctx, span := auth.startSpan(ctx, "auth.FindToken")
+	token, err = auth.tokenStore().FindToken(ctx, id)
+	endSpan(span, err)
+	return
+}
+
+func (auth *Auth) findUser(ctx context.Context, id bson.ObjectId) (user *User, err error) {
+	ctx, span := auth.startSpan(ctx, "auth.FindUser")
+	user, err = auth.userStore().FindUser(ctx, id)
+	endSpan(span, err)
+	return
+}
@@ -0,0 +1,124 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	ginResource "github.com/otamoe/gin-server/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	auth := NewAuth(Options{TracerProvider: provider})
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	// 父 span 在 gin 请求的 context 里
+	parentContext, parent := provider.Tracer("test").Start(context.Background(), "request")
+	ginContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ginContext.Request = httptest.NewRequest("GET", "/", nil).WithContext(parentContext)
+	ginContext.Set("key", "value")
+
+	// 还可以 读取 gin Keys
+	ctx, span := auth.startSpan(ginContext, "auth.VerifyToken")
+	if ctx.Value("key") != "value" || trace.SpanFromContext(upstreamContext(ctx)) != span {
+		t.Fatal("gin context")
+	}
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	if _, _, err := auth.doUpstream(ctx, upstreamToken, request, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	token := &Token{auth: auth, Type: "access"}
+	token.ValidateScopeContext(parentContext, &ginResource.Resource{Application: bson.NewObjectId(), Action: "get"})
+	parent.End()
+
+	traceID := parent.SpanContext().TraceID()
+	if traceparent == "" || traceparent[3:35] != traceID.String() {
+		t.Fatal("traceparent", traceparent)
+	}
+	names := map[string]sdktrace.ReadOnlySpan{}
+	for _, value := range recorder.Ended() {
+		if value.SpanContext().TraceID() != traceID {
+			t.Fatal("trace id", value.Name())
+		}
+		names[value.Name()] = value
+	}
+	if upstream, ok := names["auth.upstream.token"]; !ok || upstream.Parent().SpanID() != span.SpanContext().SpanID() {
+		t.Fatal("auth.upstream.token", names)
+	}
+	var decision string
+	if validate, ok := names["auth.ValidateScope"]; ok {
+		for _, value := range validate.Attributes() {
+			if value.Key == "auth.decision" {
+				decision = value.Value.AsString()
+			}
+		}
+	}
+	if decision != "deny" {
+		t.Fatal("auth.decision", decision)
+	}
+}
+
+// 记录 Audit 的 ctx
+type testAuditSink struct {
+	ctx context.Context
+}
+
+func (sink *testAuditSink) Audit(ctx context.Context, event *AuditEvent) error {
+	sink.ctx = ctx
+	return nil
+}
+
+func TestScopeMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	sink := &testAuditSink{}
+	auth := NewAuth(Options{TracerProvider: provider, AuditLog: sink})
+	application := bson.NewObjectId()
+
+	parentContext, parent := provider.Tracer("test").Start(context.Background(), "request")
+	engine := gin.New()
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Request = ctx.Request.WithContext(parentContext)
+		ctx.Set("key", "value")
+		ctx.Set(CONTEXT_TOKEN, &Token{auth: auth, Type: "access"})
+		ctx.Set(ginResource.CONTEXT, &ginResource.Resource{Application: application, Action: "get"})
+	}, ScopeMiddleware(true))
+	var called bool
+	engine.GET("/", func(ctx *gin.Context) {
+		called = true
+	})
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	parent.End()
+
+	if called {
+		t.Fatal("required")
+	}
+	// AuditSink 可以 读取 gin Keys
+	if sink.ctx == nil || sink.ctx.Value("key") != "value" {
+		t.Fatal("audit ctx", sink.ctx)
+	}
+	for _, value := range recorder.Ended() {
+		if value.Name() == "auth.ValidateScope" {
+			if value.Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Fatal("parent", value.Parent())
+			}
+			return
+		}
+	}
+	t.Fatal("auth.ValidateScope span")
+}
@@ -0,0 +1,233 @@
+package model
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/otamoe/gin-server/errs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	// 每个 上游 请求的 超时,  0 是 10 秒
+	Timeouts struct {
+		Token         time.Duration
+		User          time.Duration
+		Keys          time.Duration
+		Introspection time.Duration
+		Revocations   time.Duration
+	}
+
+	// 幂等 GET 请求 网络错误 或 5xx 时 重试,  间隔 从 Min 指数增加 到 Max 并加 随机
+	RetryConfig struct {
+		// 一共 请求 次数,  0 是 3,  1 不重试
+		Attempts int
+		Min      time.Duration
+		Max      time.Duration
+	}
+
+	// 同一个 host 连续失败 Failures 次 后 熔断 Open,  之后 只放 一个 请求 试探
+	BreakerConfig struct {
+		// 0 是 5,  小于 0 不熔断
+		Failures int
+		Open     time.Duration
+	}
+
+	circuitBreaker struct {
+		sync.Mutex
+		failures int
+		openedAt time.Time
+		probing  bool
+	}
+)
+
+const (
+	upstreamToken         = "token"
+	upstreamUser          = "user"
+	upstreamKeys          = "keys"
+	upstreamIntrospection = "introspection"
+	upstreamRevocations   = "revocations"
+)
+
+var ErrUpstreamUnavailable error = &errs.Error{
+	Message:    "Upstream service is unavailable",
+	Type:       "upstream_unavailable",
+	StatusCode: http.StatusServiceUnavailable,
+}
+
+func (timeouts Timeouts) get(endpoint string) (timeout time.Duration) {
+	switch endpoint {
+	case upstreamToken:
+		timeout = timeouts.Token
+	case upstreamUser:
+		timeout = timeouts.User
+	case upstreamKeys:
+		timeout = timeouts.Keys
+	case upstreamIntrospection:
+		timeout = timeouts.Introspection
+	case upstreamRevocations:
+		timeout = timeouts.Revocations
+	}
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	return
+}
+
+func (retry RetryConfig) backoff(attempt int) time.Duration {
+	if retry.Min <= 0 {
+		retry.Min = time.Millisecond * 100
+	}
+	if retry.Max < retry.Min {
+		retry.Max = time.Second * 2
+	}
+	d := retry.Min << uint(attempt-1)
+	if d > retry.Max || d <= 0 {
+		d = retry.Max
+	}
+	// 一半 固定 一半 随机,  避免 所有 实例 同时 重试
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (breaker *circuitBreaker) allow(c BreakerConfig, now time.Time) bool {
+	if c.Failures < 0 {
+		return true
+	}
+	if c.Open <= 0 {
+		c.Open = time.Second * 30
+	}
+	breaker.Lock()
+	defer breaker.Unlock()
+	if breaker.openedAt.IsZero() {
+		return true
+	}
+	if now.Sub(breaker.openedAt) < c.Open || breaker.probing {
+		return false
+	}
+	breaker.probing = true
+	return true
+}
+
+func (breaker *circuitBreaker) done(c BreakerConfig, failed bool, now time.Time) {
+	if c.Failures < 0 {
+		return
+	}
+	if c.Failures == 0 {
+		c.Failures = 5
+	}
+	breaker.Lock()
+	defer breaker.Unlock()
+	breaker.probing = false
+	if !failed {
+		breaker.failures = 0
+		breaker.openedAt = time.Time{}
+		return
+	}
+	breaker.failures++
+	if !breaker.openedAt.IsZero() || breaker.failures >= c.Failures {
+		breaker.openedAt = now
+	}
+}
+
+// 调用方 取消 不算 成功 也 不算 失败,  只 允许 下一个 请求 试探
+func (breaker *circuitBreaker) cancel() {
+	breaker.Lock()
+	defer breaker.Unlock()
+	breaker.probing = false
+}
+
+func (auth *Auth) getBreaker(host string) *circuitBreaker {
+	value, _ := auth.breakers.LoadOrStore(host, &circuitBreaker{})
+	return value.(*circuitBreaker)
+}
+
+// gin.Context 没有 Done Deadline,  使用 请求的 context,  并 保留 startSpan 的 span
+func upstreamContext(ctx context.Context) context.Context {
+	ginContext, ok := ctx.(*gin.Context)
+	if !ok {
+		if ginContext, ok = ctx.Value(ginContextKey{}).(*gin.Context); !ok {
+			return ctx
+		}
+	}
+	requestContext := context.Background()
+	if ginContext.Request != nil {
+		requestContext = ginContext.Request.Context()
+	}
+	if span := trace.SpanFromContext(ctx); span.SpanContext().IsValid() {
+		requestContext = trace.ContextWithSpan(requestContext, span)
+	}
+	return requestContext
+}
+
+// 请求 上游 并 读取 最多 limit 字节,  超时 重试 熔断 按 Options 配置.  超时 是 ctx deadline 之外的 上限
+func (auth *Auth) doUpstream(ctx context.Context, endpoint string, request *http.Request, limit int64) (statusCode int, bodyBytes []byte, err error) {
+	start := time.Now()
+	ctx, span := auth.startSpan(upstreamContext(ctx), "auth.upstream."+endpoint,
+		attribute.String("http.request.method", request.Method),
+		attribute.String("server.address", request.URL.Host),
+	)
+	defer func() {
+		auth.metrics.upstream(endpoint, statusCode, err, start)
+		if statusCode != 0 {
+			span.SetAttributes(attribute.Int("http.response.status_code", statusCode))
+		}
+		if err == nil && statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(statusCode))
+		}
+		endSpan(span, err)
+	}()
+	options := auth.Options()
+	breaker := auth.getBreaker(request.URL.Host)
+	if !breaker.allow(options.Breaker, time.Now()) {
+		err = ErrUpstreamUnavailable
+		return
+	}
+
+	timeoutContext, timeoutCancel := context.WithTimeout(ctx, options.Timeouts.get(endpoint))
+	defer timeoutCancel()
+	request = request.WithContext(timeoutContext)
+	auth.propagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+
+	attempts := 1
+	if request.Method == http.MethodGet {
+		if attempts = options.Retry.Attempts; attempts == 0 {
+			attempts = 3
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		statusCode, bodyBytes, err = auth.roundTrip(request, limit)
+		if (err == nil && statusCode < http.StatusInternalServerError) || attempt >= attempts {
+			break
+		}
+		if !sleepContext(timeoutContext, options.Retry.backoff(attempt)) {
+			break
+		}
+	}
+	// 调用方 取消 或 超过 调用方 deadline 不算 上游 失败
+	if err != nil && ctx.Err() != nil {
+		breaker.cancel()
+		return
+	}
+	breaker.done(options.Breaker, err != nil || statusCode >= http.StatusInternalServerError, time.Now())
+	return
+}
+
+func (auth *Auth) roundTrip(request *http.Request, limit int64) (statusCode int, bodyBytes []byte, err error) {
+	var response *http.Response
+	if response, err = auth.httpClient().Do(request); err != nil {
+		return
+	}
+	defer response.Body.Close()
+	statusCode = response.StatusCode
+	bodyBytes, err = ioutil.ReadAll(io.LimitReader(response.Body, limit))
+	return
+}
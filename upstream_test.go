@@ -0,0 +1,127 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoUpstream(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt32(&requests, 1); n%3 != 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	auth := NewAuth(Options{
+		Retry:   RetryConfig{Attempts: 3, Min: time.Millisecond, Max: time.Millisecond * 2},
+		Breaker: BreakerConfig{Failures: 2, Open: time.Minute},
+	})
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	statusCode, bodyBytes, err := auth.doUpstream(context.Background(), upstreamKeys, request, 1<<20)
+	if err != nil || statusCode != http.StatusOK || string(bodyBytes) != "ok" || requests != 3 {
+		t.Fatal("retry", statusCode, string(bodyBytes), err, requests)
+	}
+
+	// POST 不重试
+	for i := 0; i < 2; i++ {
+		request, _ = http.NewRequest("POST", server.URL, nil)
+		if statusCode, _, _ = auth.doUpstream(context.Background(), upstreamIntrospection, request, 1<<20); statusCode != http.StatusBadGateway {
+			t.Fatal("POST", statusCode)
+		}
+	}
+	if requests != 5 {
+		t.Fatal("POST requests", requests)
+	}
+
+	// 连续 失败 2 次 熔断
+	request, _ = http.NewRequest("GET", server.URL, nil)
+	if _, _, err = auth.doUpstream(context.Background(), upstreamKeys, request, 1<<20); err != ErrUpstreamUnavailable || requests != 5 {
+		t.Fatal("breaker", err, requests)
+	}
+}
+
+func TestDoUpstreamContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second * 5):
+		}
+	}))
+	defer server.Close()
+
+	auth := NewAuth(Options{Breaker: BreakerConfig{Failures: 1, Open: time.Minute}})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	start := time.Now()
+	if _, _, err := auth.doUpstream(ctx, upstreamUser, request, 1<<20); err == nil || time.Since(start) > time.Second {
+		t.Fatal("deadline", err, time.Since(start))
+	}
+	// 调用方 超时 不熔断
+	if !auth.getBreaker(request.URL.Host).allow(BreakerConfig{Failures: 1, Open: time.Minute}, time.Now()) {
+		t.Fatal("breaker open")
+	}
+}
+
+func TestDoUpstreamHalfOpen(t *testing.T) {
+	var status int32 = http.StatusBadGateway
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch code := atomic.LoadInt32(&status); code {
+		case 0:
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(int(code))
+		}
+	}))
+	defer server.Close()
+
+	auth := NewAuth(Options{
+		Retry:   RetryConfig{Attempts: 1},
+		Breaker: BreakerConfig{Failures: 2, Open: time.Millisecond * 100},
+	})
+	do := func(ctx context.Context) (statusCode int, err error) {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		statusCode, _, err = auth.doUpstream(ctx, upstreamKeys, request, 1<<20)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		do(context.Background())
+	}
+	if _, err := do(context.Background()); err != ErrUpstreamUnavailable {
+		t.Fatal("open", err)
+	}
+
+	// 试探 请求 被 调用方 取消,  保持 熔断
+	time.Sleep(time.Millisecond * 150)
+	atomic.StoreInt32(&status, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := do(ctx); err == nil || err == ErrUpstreamUnavailable {
+		t.Fatal("probe cancel", err)
+	}
+	// 下一个 试探 失败 一次 就 再次 熔断
+	atomic.StoreInt32(&status, http.StatusBadGateway)
+	if statusCode, err := do(context.Background()); err != nil || statusCode != http.StatusBadGateway {
+		t.Fatal("probe", statusCode, err)
+	}
+	if _, err := do(context.Background()); err != ErrUpstreamUnavailable {
+		t.Fatal("reopen", err)
+	}
+
+	// Open 之后 试探 成功 恢复
+	time.Sleep(time.Millisecond * 150)
+	atomic.StoreInt32(&status, http.StatusOK)
+	for i := 0; i < 2; i++ {
+		if statusCode, err := do(context.Background()); err != nil || statusCode != http.StatusOK {
+			t.Fatal("closed", statusCode, err)
+		}
+	}
+}
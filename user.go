@@ -23,8 +23,16 @@ type User struct {
 	Birthday              *time.Time    `json:"birthday,omitempty" bson:"birthday,omitempty"`
 	CreatedAt             *time.Time    `json:"created_at,omitempty" bson:"created_at,omitempty"`
 	UpdatedAt             *time.Time    `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	// 最后一次 从 UserOrigin 获取的时间
+	FetchedAt *time.Time `json:"-" bson:"fetched_at,omitempty"`
 }
 
+const (
+	userFresh = iota
+	userStale
+	userExpired
+)
+
 var (
 	ErrUserRequired error = &errs.Error{
 		Message:    "User is required",
@@ -66,3 +74,66 @@ var ModelUser = &mgoModel.Model{
 	Document: &User{},
 	Indexs:   []mgo.Index{},
 }
+
+// upsert 的 更新,  mgo 和 mongo driver 共用
+func (user *User) upsertUpdate(fetchedAt time.Time) bson.M {
+	set := bson.M{
+		"username":   user.Username,
+		"nickname":   user.Nickname,
+		"fetched_at": fetchedAt,
+	}
+	unset := bson.M{}
+	for name, value := range map[string]string{
+		"avatar":      user.Avatar,
+		"locale":      user.Locale,
+		"description": user.Description,
+		"gender":      user.Gender,
+	} {
+		if value == "" {
+			unset[name] = ""
+		} else {
+			set[name] = value
+		}
+	}
+	for name, value := range map[string]*time.Time{
+		"birthday":   user.Birthday,
+		"created_at": user.CreatedAt,
+		"updated_at": user.UpdatedAt,
+	} {
+		if value == nil {
+			unset[name] = ""
+		} else {
+			set[name] = *value
+		}
+	}
+
+	update := bson.M{"$set": set}
+	if len(unset) != 0 {
+		update["$unset"] = unset
+	}
+	if len(user.AuthTypes) != 0 {
+		update["$setOnInsert"] = bson.M{"auth_types": user.AuthTypes}
+	}
+	return update
+}
+
+// maxAge 之内 fresh,  hardMaxAge 之后 expired,  0 不限制.  没有 FetchedAt 的 旧数据 当作 无限久
+func (user *User) staleness(maxAge time.Duration, hardMaxAge time.Duration, now time.Time) int {
+	if maxAge <= 0 && hardMaxAge <= 0 {
+		return userFresh
+	}
+	expired := hardMaxAge > 0
+	stale := maxAge > 0
+	if user.FetchedAt != nil {
+		age := now.Sub(*user.FetchedAt)
+		expired = expired && age > hardMaxAge
+		stale = stale && age > maxAge
+	}
+	if expired {
+		return userExpired
+	}
+	if stale {
+		return userStale
+	}
+	return userFresh
+}
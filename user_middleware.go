@@ -4,16 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"io"
-	"io/ioutil"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
 	"github.com/otamoe/gin-server/errs"
+	mgoModel "github.com/otamoe/mgo-model"
 	"github.com/sirupsen/logrus"
 
 	"github.com/gin-gonic/gin"
@@ -23,10 +22,18 @@ type (
 	UserConfig struct {
 		Fetch bool
 		Cache bool
+
+		// 缓存的用户 超过 MaxAge 后台 从 UserOrigin 刷新,  超过 HardMaxAge 同步 重新获取,  0 不限制.  需要 Fetch
+		MaxAge     time.Duration
+		HardMaxAge time.Duration
 	}
 )
 
 func UserMiddleware(c UserConfig) gin.HandlerFunc {
+	return defaultAuth.UserMiddleware(c)
+}
+
+func (auth *Auth) UserMiddleware(c UserConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		var err error
 		defer func() {
@@ -39,105 +46,122 @@ func UserMiddleware(c UserConfig) gin.HandlerFunc {
 		}()
 
 		if userParam := ctx.Param("user"); userParam != "" {
-			_, err = GetUser(ctx, userParam, c.Cache, c.Fetch)
+			_, err = auth.GetUserWithConfig(ctx, c, userParam)
 		}
 	}
 }
 
 func GetUser(ctx *gin.Context, val string, cache bool, fetch bool) (user *User, err error) {
+	return defaultAuth.GetUserWithConfig(ctx, UserConfig{Cache: cache, Fetch: fetch}, val)
+}
+
+func GetUserWithConfig(ctx *gin.Context, c UserConfig, val string) (user *User, err error) {
+	return defaultAuth.GetUserWithConfig(ctx, c, val)
+}
+
+func (auth *Auth) GetUserWithConfig(ctx *gin.Context, c UserConfig, val string) (user *User, err error) {
 	key := "user"
 	value, ok := ctx.Get(key)
 	if user, ok = value.(*User); ok {
+		if user.ID.Hex() != val {
+			err = ErrUserNotFound
+			return
+		}
+		return
+	}
+	if user, err = auth.LookupUser(ctx, c, val); err != nil {
+		return
+	}
+	ctx.Set(key, user)
+	return
+}
 
-	} else {
-		if val == "me" {
-			if v, ok := ctx.Get(CONTEXT_TOKEN); ok {
-				user = v.(*Token).User
-				if user == nil {
-					err = ErrUserNotFound
-					return
-				}
-				val = user.ID.Hex()
-			} else {
-				err = ErrUserNotFound
-				return
-			}
-		} else {
-			if !bson.IsObjectIdHex(val) {
-				err = ErrUserNotFound
-				return
-			}
-			user = &User{}
-			if user.ID == "" && cache {
-				if err = ModelUser.Query(ctx).ID(val).One(user); err != nil {
-					if err != mgo.ErrNotFound {
-						return
-					}
-					err = nil
-				}
-			}
-			if user.ID == "" && fetch {
-				if user, err = requestUser(val); err != nil {
-					if err != mgo.ErrNotFound {
-						return
-					}
-					user = &User{}
-					err = nil
-				} else if cache {
-					user.New(ctx, ModelUser, user, true)
-					if err = user.Save(); err != nil && !mgo.IsDup(err) {
-						return
-					}
-					err = nil
-				}
-			}
-			if user.ID == "" {
-				err = ErrUserNotFound
-				return
-			}
+// 后台 刷新 用户,  同一个 用户 同时 只有一个.  请求结束后 mongo session 会关闭 所以复制一个
+// Start 之后 由 Handle 管理,  Stop 时 取消 并 等待
+func (auth *Auth) refreshUserBackground(ctx context.Context, val string) {
+	if _, loaded := auth.userRefreshing.LoadOrStore(val, true); loaded {
+		return
+	}
+	session, ok := ctx.Value(mgoModel.CONTEXT).(*mgo.Session)
+	if ok {
+		session = session.Copy()
+	}
+	refresh := func(ctx context.Context) {
+		defer auth.userRefreshing.Delete(val)
+		if session != nil {
+			defer session.Close()
+			ctx = context.WithValue(ctx, mgoModel.CONTEXT, session)
+		}
+		if _, err := auth.fetchUser(ctx, val, true); err != nil {
+			logrus.Error("[USER_REFRESH]", err)
 		}
-		ctx.Set("user", user)
 	}
-	if user.ID.Hex() != val {
-		err = ErrUserNotFound
+
+	// Stop 先 清除 handle,  锁 里 添加 不会 在 Wait 之后
+	auth.running.Lock()
+	defer auth.running.Unlock()
+	if handle := auth.running.handle; handle != nil {
+		handle.Go(refresh)
+		return
+	}
+	go refresh(context.Background())
+}
+
+// 同步 重新获取 用户
+func (auth *Auth) refreshUser(ctx context.Context, val string) (user *User, err error) {
+	var value interface{}
+	if value, err, _ = auth.userFlight.DoContext(ctx, fmt.Sprintf("%s:%t", val, true), func() (interface{}, error) {
+		return auth.fetchUser(ctx, val, true)
+	}); err != nil {
+		if err == ErrNotFound {
+			err = ErrUserNotFound
+		}
 		return
 	}
+	user = value.(*User).clone()
 	return
 }
 
-func requestUser(val string) (user *User, err error) {
-	if UserOrigin == "" {
-		err = errors.New("auth-model.UserOrigin variable not configured")
+func (auth *Auth) fetchUser(ctx context.Context, val string, cache bool) (user *User, err error) {
+	if user, err = auth.requestUser(ctx, val); err != nil {
 		return
 	}
-	var request *http.Request
-	var response *http.Response
+	if cache {
+		if user, err = auth.userStore().UpsertUser(ctx, user); err != nil {
+			return
+		}
+		auth.cacheSetUser(user)
+		auth.cacheSetTokenUser(user)
+	}
+	return
+}
 
-	timeoutContext, timeoutCancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer timeoutCancel()
-	client := &http.Client{}
-	if request, err = http.NewRequest("GET", UserOrigin+"/"+url.QueryEscape(val)+"/", nil); err != nil {
+func (auth *Auth) requestUser(ctx context.Context, val string) (user *User, err error) {
+	userOrigin := auth.Options().UserOrigin
+	if userOrigin == "" {
+		err = errors.New("auth-model.UserOrigin variable not configured")
 		return
 	}
-	request = request.WithContext(timeoutContext)
-	if response, err = client.Do(request); err != nil {
+	var request *http.Request
+	if request, err = http.NewRequest("GET", userOrigin+"/"+url.QueryEscape(val)+"/", nil); err != nil {
 		return
 	}
-	defer response.Body.Close()
+
+	var statusCode int
 	var bodyBytes []byte
-	if bodyBytes, err = ioutil.ReadAll(io.LimitReader(response.Body, 1<<20)); err != nil {
+	if statusCode, bodyBytes, err = auth.doUpstream(ctx, upstreamUser, request, 1<<20); err != nil {
 		return
 	}
 
-	logrus.Debugf("[USER] %d %s", response.StatusCode, string(bodyBytes))
+	logrus.Debugf("[USER] %d %s", statusCode, string(bodyBytes))
 
-	if response.StatusCode >= http.StatusMultipleChoices {
+	if statusCode >= http.StatusMultipleChoices {
 		userErrors := &Errors{}
 		if err = json.Unmarshal(bodyBytes, userErrors); err != nil {
 			return
 		}
 		if userErrors.StatusCode == http.StatusNotFound {
-			err = mgo.ErrNotFound
+			err = ErrNotFound
 		} else {
 			message := []string{}
 			for _, val := range userErrors.Errors {
@@ -0,0 +1,212 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type (
+	tokenContextKey struct{}
+	userContextKey  struct{}
+)
+
+func NewContextWithToken(ctx context.Context, token *Token) context.Context {
+	return context.WithValue(ctx, tokenContextKey{}, token)
+}
+
+// 也可以读取 gin.Context 里的 token
+func TokenFromContext(ctx context.Context) (token *Token, ok bool) {
+	if token, ok = ctx.Value(tokenContextKey{}).(*Token); ok {
+		return
+	}
+	token, ok = ctx.Value(CONTEXT_TOKEN).(*Token)
+	return
+}
+
+func NewContextWithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// 也可以读取 gin.Context 里的 user
+func UserFromContext(ctx context.Context) (user *User, ok bool) {
+	if user, ok = ctx.Value(userContextKey{}).(*User); ok {
+		return
+	}
+	user, ok = ctx.Value("user").(*User)
+	return
+}
+
+// 验证 token 字符串,  没有请求 DPoP 绑定的 token 按 Bearer 处理,  CertificateBound 会失败
+func VerifyToken(ctx context.Context, c TokenConfig, val string) (token *Token, err error) {
+	return defaultAuth.VerifyToken(ctx, c, val)
+}
+
+func (auth *Auth) VerifyToken(ctx context.Context, c TokenConfig, val string) (token *Token, err error) {
+	current, _ := TokenFromContext(ctx)
+	return auth.verifyToken(ctx, c, nil, nil, current, val)
+}
+
+// 从请求 按 Sources 读取 并 验证 token,  没有 token 返回 nil.  header 是 响应 header,  写入 WWW-Authenticate DPoP-Nonce
+func VerifyRequest(ctx context.Context, c TokenConfig, request *http.Request, header http.Header) (token *Token, err error) {
+	return defaultAuth.VerifyRequest(ctx, c, request, header)
+}
+
+func (auth *Auth) VerifyRequest(ctx context.Context, c TokenConfig, request *http.Request, header http.Header) (token *Token, err error) {
+	val, _ := c.readToken(request)
+	if val == "" {
+		return
+	}
+	current, _ := TokenFromContext(ctx)
+	return auth.verifyToken(ctx, c, request, header, current, val)
+}
+
+func (auth *Auth) verifyToken(ctx context.Context, c TokenConfig, request *http.Request, header http.Header, current *Token, val string) (token *Token, err error) {
+	types := c.Types
+
+	// 注册了 其他 issuer 时 按 iss 选择 公钥 缓存 和 UserOrigin
+	verifier := c.verifier(val)
+	if verifier == VerifierJWT {
+		auth = auth.tokenIssuer(val)
+	}
+
+	ctx, span := auth.startSpan(ctx, "auth.VerifyToken", attribute.String("auth.verifier", verifier))
+	defer func() {
+		if err == nil && token != nil {
+			span.SetAttributes(tokenAttributes(token)...)
+		}
+		endSpan(span, err)
+	}()
+
+	if current == nil {
+		if cachedErr, ok := auth.negativeCacheGet(val); ok {
+			err = cachedErr
+			return
+		}
+	}
+
+	var claims *TokenClaims
+	if verifier == VerifierIntrospection {
+		token, claims, err = auth.getIntrospectionToken(ctx, c, current, val)
+	} else {
+		token, claims, err = auth.getJWTToken(ctx, c, current, val)
+	}
+	if err != nil {
+		return
+	}
+	if claims.Issuer != "" {
+		token.Issuer = claims.Issuer
+	}
+	token.auth = auth
+
+	if c.DPoP {
+		if err = auth.checkDPoP(request, header, c, val, claims); err != nil {
+			return
+		}
+	}
+
+	if c.CertificateBound {
+		if err = checkCertificateBound(request, c, claims); err != nil {
+			return
+		}
+	}
+
+	if err = auth.checkTokenRevoked(ctx, c.Cache, token, claims); err != nil {
+		return
+	}
+
+	if len(types) != 0 {
+		sort.Strings(types)
+		if i := sort.SearchStrings(types, token.Type); i == len(types) || types[i] != token.Type {
+			err = ErrTokenNotFound
+			return
+		}
+	}
+
+	if c.Expired && token.ExpiredAt != nil && token.ExpiredAt.Add(c.ClockSkew).Before(time.Now()) {
+		err = ErrTokenHasExpired
+		return
+	}
+
+	return
+}
+
+// 读取 用户,  "me" 是 context 里 token 的用户
+func LookupUser(ctx context.Context, c UserConfig, val string) (user *User, err error) {
+	return defaultAuth.LookupUser(ctx, c, val)
+}
+
+func (auth *Auth) LookupUser(ctx context.Context, c UserConfig, val string) (user *User, err error) {
+	if val == "me" {
+		token, ok := TokenFromContext(ctx)
+		if !ok || token.User == nil {
+			err = ErrUserNotFound
+			return
+		}
+		user = token.User
+		return
+	}
+	if !bson.IsObjectIdHex(val) {
+		err = ErrUserNotFound
+		return
+	}
+	// 和 token 同一个 issuer 的 用户
+	if token, ok := TokenFromContext(ctx); ok {
+		auth = auth.issuer(token.Issuer)
+	}
+
+	ctx, span := auth.startSpan(ctx, "auth.LookupUser", attribute.Bool("auth.cache", c.Cache), attribute.Bool("auth.fetch", c.Fetch))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	user = &User{}
+	if c.Cache {
+		if cached, ok := auth.cacheGetUser(val); ok {
+			user = cached
+		} else if stored, e := auth.findUser(ctx, bson.ObjectIdHex(val)); e != nil {
+			if e != ErrNotFound {
+				err = e
+				return
+			}
+		} else {
+			user = stored
+			auth.cacheSetUser(user)
+			auth.metrics.storeLookup(ModelUser.Name, "hit")
+		}
+		if user.ID != "" && c.Fetch {
+			switch user.staleness(c.MaxAge, c.HardMaxAge, time.Now()) {
+			case userStale:
+				auth.refreshUserBackground(ctx, val)
+			case userExpired:
+				user = &User{}
+			}
+		}
+	}
+	if user.ID == "" && c.Fetch {
+		// 同一个 用户 并发 只请求一次
+		var value interface{}
+		if value, err, _ = auth.userFlight.DoContext(ctx, fmt.Sprintf("%s:%t", val, c.Cache), func() (interface{}, error) {
+			auth.metrics.storeLookup(ModelUser.Name, "fetch")
+			return auth.fetchUser(ctx, val, c.Cache)
+		}); err != nil {
+			if err != ErrNotFound {
+				return
+			}
+			user = &User{}
+			err = nil
+		} else {
+			user = value.(*User).clone()
+		}
+	}
+	if user.ID.Hex() != val {
+		err = ErrUserNotFound
+		return
+	}
+	return
+}
@@ -0,0 +1,173 @@
+package model
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/globalsign/mgo/bson"
+)
+
+type testSigner struct {
+	kid        string
+	privateKey ed25519.PrivateKey
+	publicKeys *TokenPublicKeys
+	body       []byte
+}
+
+// Ed25519 公钥 和 JWKS
+func newTestSigner(t *testing.T, kid string) *testSigner {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "OKP",
+				"kid": kid,
+				"crv": "Ed25519",
+				"x":   base64.RawURLEncoding.EncodeToString(publicKey),
+			},
+		},
+	})
+	publicKeys, err := parseTokenPublicKeys(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{kid: kid, privateKey: privateKey, publicKeys: publicKeys, body: body}
+}
+
+func (signer *testSigner) sign(t *testing.T, claims jwt.Claims) string {
+	jwtToken := jwt.NewWithClaims(SigningMethodEd25519, claims)
+	jwtToken.Header["kid"] = signer.kid
+	val, err := jwtToken.SignedString(signer.privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val
+}
+
+// token 的 JWT
+func (signer *testSigner) token(t *testing.T, token *Token, issuer string) string {
+	return signer.sign(t, &TokenClaims{
+		Name:   "token",
+		UserID: token.UserID,
+		Type:   token.Type,
+		StandardClaims: jwt.StandardClaims{
+			Subject:  token.ID.Hex(),
+			Issuer:   issuer,
+			IssuedAt: time.Now().Add(-time.Minute).Unix(),
+		},
+	})
+}
+
+// 使用 MemoryStore 和 signer 公钥 的 Auth,  store 里 有 一个 token 和 用户
+func newTestAuth(t *testing.T, signer *testSigner, options Options) (auth *Auth, store *MemoryStore, token *Token) {
+	store = NewMemoryStore()
+	options.TokenStore, options.UserStore = store, store
+	auth = NewAuth(options)
+	auth.keys.publicKeys.Store(signer.publicKeys)
+
+	ctx := context.Background()
+	user, err := store.UpsertUser(ctx, &User{ID: bson.NewObjectId(), Username: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredAt := time.Now().Add(time.Hour)
+	token = &Token{ID: bson.NewObjectId(), Type: "access", UserID: user.ID, ExpiredAt: &expiredAt}
+	if err = store.InsertToken(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestVerifyTokenRevoked(t *testing.T) {
+	signer := newTestSigner(t, "key")
+	auth, store, token := newTestAuth(t, signer, Options{})
+	ctx := context.Background()
+	c := TokenConfig{Cache: true}
+	val := signer.token(t, token, "")
+
+	if _, err := auth.VerifyToken(ctx, c, val); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.RevokeToken(ctx, token.ID, nil, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.VerifyToken(ctx, c, val); err != ErrTokenRevoked {
+		t.Fatal("denylist", err)
+	}
+
+	// 其他 实例 写入的 撤销 从 TokenStore 读取
+	other := NewAuth(Options{TokenStore: store, UserStore: store})
+	other.keys.publicKeys.Store(signer.publicKeys)
+	if _, err := other.VerifyToken(ctx, c, val); err != ErrTokenRevoked {
+		t.Fatal("TokenStore", err)
+	}
+
+	// 用户 撤销 之前 签发的 token
+	auth, _, token = newTestAuth(t, signer, Options{})
+	val = signer.token(t, token, "")
+	if err := auth.RevokeUser(ctx, token.UserID, time.Now(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.VerifyToken(ctx, c, val); err != ErrTokenRevoked {
+		t.Fatal("RevokeUser", err)
+	}
+}
+
+func TestVerifyTokenNegativeCache(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errors":[{"message":"Token not found"}],"status_code":401}`))
+	}))
+	defer server.Close()
+	signer := newTestSigner(t, "key")
+	auth, _, _ := newTestAuth(t, signer, Options{UserOrigin: server.URL, Caches: CacheConfig{NegativeSize: 10, NegativeTTL: time.Millisecond * 100}})
+	ctx := context.Background()
+
+	// 上游 401
+	val := signer.token(t, &Token{ID: bson.NewObjectId(), Type: "access", UserID: bson.NewObjectId()}, "")
+	for i := 0; i < 3; i++ {
+		if _, err := auth.VerifyToken(ctx, TokenConfig{}, val); err == nil || !isUpstreamRejection(err) {
+			t.Fatal("upstream", err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatal("requests", n)
+	}
+	if stats := auth.GetNegativeCacheStats(); stats.Hits != 2 || stats.Len != 1 {
+		t.Fatal("stats", stats)
+	}
+
+	// 签名 错误 不请求 上游
+	other := newTestSigner(t, "key").token(t, &Token{ID: bson.NewObjectId()}, "")
+	for i := 0; i < 2; i++ {
+		if _, err := auth.VerifyToken(ctx, TokenConfig{}, other); err == nil {
+			t.Fatal("signature")
+		}
+	}
+	if stats := auth.GetNegativeCacheStats(); stats.Hits != 3 || stats.Len != 2 {
+		t.Fatal("signature stats", stats)
+	}
+
+	// 过期 后 重新 请求
+	time.Sleep(time.Millisecond * 150)
+	if _, err := auth.VerifyToken(ctx, TokenConfig{}, val); err == nil {
+		t.Fatal("expired")
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatal("expired requests", n)
+	}
+}